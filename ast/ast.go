@@ -1,11 +1,19 @@
 package ast
 
+import (
+	"reflect"
+	"text/template/parse"
+)
+
 // An Expression is a snippet of JavaScript code that can be evaluated.
 //
 // Expressions are always one of:
 //  Literal      "foo bar"
 //  Field        (a.b)
 //  Method       (a.b(...))
+//  Dynamic      $dynamic(a, "b", [...])
+//  Compare      $eq(a, b, ...)
+//  Call         $call(f, [...])
 //  Local        (a)
 //  SetLocal     (a = (...))
 //  Context      ctx
@@ -24,6 +32,9 @@ type Expression interface {
 //  Conditional    if (...) { ... } else { ... }
 //  Loop           while (...) { ... }
 //  Include        out += renderTemplate("name", ...);
+//  Break          return 1;
+//  Continue       return 2;
+//  Comment        /* ... */
 type Statement interface {
 	stmt() string
 }
@@ -32,15 +43,23 @@ type Statement interface {
 
 // A Literal is a JSON value that can be injected into the template.
 type Literal struct {
+	IntVal    *int64
 	FloatVal  *float64
 	BoolVal   *bool
 	StringVal *string
+
+	// If true, IntVal is emitted as a BigInt (see Options.BigIntegers).
+	Big bool
 }
 
 // A Field accesses a named property of an object.
 type Field struct {
 	Subject Expression
 	Name    string
+
+	// For map lookups, what to do when the key is missing (see
+	// Options.MissingKey).
+	MissingKey string
 }
 
 // A Method accesses and invokes a named property of an object.
@@ -50,6 +69,30 @@ type Method struct {
 	Args    []Expression
 }
 
+// A Dynamic accesses a named property of an object whose type is only known
+// at runtime; if the property is a function, it is invoked.
+type Dynamic struct {
+	Subject Expression
+	Name    string
+	Args    []Expression
+
+	// If true, raise an error when the property does not exist.
+	Checked bool
+}
+
+// A Compare compares its arguments with one of the comparison builtins (eq,
+// ne, lt, le, gt or ge), following the rules of text/template.
+type Compare struct {
+	Op   string
+	Args []Expression
+}
+
+// A Call invokes a function value with the call builtin.
+type Call struct {
+	Func Expression
+	Args []Expression
+}
+
 // A Local reads a given local variable from the environment.
 type Local struct {
 	Name string
@@ -90,6 +133,10 @@ type Loop struct {
 
 	// If not empty, set this variable to current iterate.
 	ValueVar string
+
+	// If true, IndexVar and ValueVar belong to an enclosing scope, and are
+	// assigned rather than declared (as with {{range $i, $e = ...}}).
+	Assign bool
 	*Scope
 }
 
@@ -105,6 +152,10 @@ type Conditional struct {
 
 	// If not empty, set this variable to the result of the conditional.
 	CondVar string
+
+	// If true, CondVar belongs to an enclosing scope, and is assigned
+	// whether or not the Body runs (as with {{if $x = ...}}).
+	Assign bool
 	*Scope
 }
 
@@ -114,10 +165,27 @@ type Include struct {
 	Context Expression
 }
 
+// A Break stops the innermost Loop. Since each iteration runs in its own
+// function, this returns 1 to the loop (through any Conditionals).
+type Break struct{}
+
+// A Continue skips to the next iteration of the innermost Loop, returning 2.
+type Continue struct{}
+
+// A Comment is a template comment, which is only kept (as a JavaScript
+// comment) with Options.Debug.
+type Comment struct {
+	Text string
+}
+
 // A SetLocal modifies the current scope and sets the given variable.
 type SetLocal struct {
 	Name  string
 	Value Expression
+
+	// If true, the variable belongs to an enclosing scope, and is assigned
+	// rather than declared (as with {{$x = ...}}).
+	Assign bool
 }
 
 // Types
@@ -126,17 +194,55 @@ type SetLocal struct {
 type function struct {
 	Args []Type
 
+	// If true, the last of Args may be repeated any number of times; the
+	// extra arguments are passed positionally, as in Go.
+	Variadic bool
+
 	// If null, function returns void.
 	Return Type
+
+	// If true, the function may also fail, as with a Go (T, error) result.
+	Error bool
+
+	// If true, this is a method of the object containing it; otherwise, it
+	// is a function value (such as a struct field), which can only be
+	// invoked with the call builtin.
+	Method bool
+
+	// If true, the function formats its arguments as text (as fmt.Sprint),
+	// so numbers should be formatted as Go would.
+	Formats bool
+
+	// If true, the arguments are first joined into a single string, as with
+	// fmt.Sprint (for the html, js and urlquery builtins).
+	Sprint bool
 }
 
+// A Comparison is one of the builtin comparison functions, which accept
+// values of any basic type (see Compare).
+type comparison struct {
+	Op string
+}
+
+// A Caller is the call builtin, which invokes a function value (see Call).
+type caller struct{}
+
 // An Object is a struct with fixed properties.
 type object struct {
+	// The name of the Go type, if any.
+	Name string
+
+	// The Go struct type, unless the object is embedded (and so its fields
+	// are encoded as part of the enclosing object).
+	Type reflect.Type
+
 	Fields map[string]Type
 
-	// Since `json:"tag"` struct tags might rename the properties,
-	// allow the use of different labels for certain fields.
-	Labels map[string]string
+	// Since encoding/json may rename, omit, quote or promote fields, this
+	// records how each field is represented in the data sent to the client.
+	// Fields missing here (other than functions, which the client provides
+	// itself) aren't sent at all.
+	JSON map[string]jsonField
 }
 
 // An Array is a container of many objects of the same type.
@@ -144,15 +250,55 @@ type array struct {
 	Contains Type
 }
 
+// A Pointer is a Go pointer to the given type, which may be null.
+type pointer struct {
+	Elem Type
+}
+
+// A Mapping is a JavaScript object holding a Go map. Its keys are always
+// strings in JavaScript, but Key may also be a number (for integer keys).
+type mapping struct {
+	Key  Type
+	Elem Type
+}
+
+// An Iterator is a Go iterator function (iter.Seq or iter.Seq2), which the
+// client provides as an array (of [key, value] pairs, for iter.Seq2), a
+// generator, or a function taking a yield callback, as in Go. Key is nil for
+// iter.Seq.
+type iterator struct {
+	Key  Type
+	Elem Type
+}
+
+// Globals are the functions available to a template, which are properties of
+// $ in JavaScript.
+type globals map[string]Type
+
 // A boolean is either true or false.
 type boolean struct{}
 
-// A Number is a JavaScipt Number ~ float64.
-type number struct{}
+// A Number is a JavaScipt Number ~ float64, holding a Go integer or float of
+// the given Kind.
+type number struct {
+	Kind reflect.Kind
+
+	// If true, the number is sent as a decimal string, and read as a BigInt
+	// (see Options.BigIntegers).
+	Big bool
+}
 
 // A String is a JavaScript UTF-8 string.
 type str struct{}
 
+// A Nothing is the missing data of a template included without any (as
+// with {{template "name"}}).
+type nothing struct{}
+
+// An Anything is a value whose type is not known until runtime (as with
+// interface{}); it accepts every argument.
+type anything struct{}
+
 // A Type is a JavaScript type.
 type Type interface {
 	// Returns the label and type of the given field.
@@ -171,4 +317,80 @@ type Scope struct {
 	Context   Type
 	Variables map[string]Type
 	Parent    *Scope
+	Options   *Options
+
+	// The functions available to the template (such as "$printf"), which are
+	// properties of $ rather than variables.
+	Funcs map[string]Type
+
+	// The JavaScript names of the variables declared in this scope, where
+	// these differ from the template's (see declare), and the number of
+	// declarations of each name in the template so far.
+	labels   map[string]string
+	declared map[string]int
+
+	// If not nil, the set of templates being converted, which records the
+	// types passed to {{template}}.
+	set *Set
+}
+
+// A Set is a group of templates that may include one another. Since each
+// template may be executed with a different type of data, the type of each
+// is inferred from the {{template}} actions that include it.
+//
+// Types are compared as Go types (ignoring pointers and addressability),
+// rather than by what the template actually uses: a template included with
+// two different struct types is an error, even if both have the fields it
+// needs.
+// The exception is a template whose data is given as interface{}, which
+// accepts anything.
+type Set struct {
+	Trees map[string]*parse.Tree
+
+	// The type of the data passed to some of the templates (such as the one
+	// executed first). Others are given the type with which they are
+	// included, or Default if they are never included.
+	Contexts map[string]Type
+	Default  Type
+
+	// The types of the functions that templates may call.
+	Funcs map[string]Type
+
+	Options *Options
+
+	queue []string
+}
+
+// Options controls the JavaScript generated for a template.
+type Options struct {
+	// If true, emit runtime assertions wherever the type of a value is not
+	// known statically (such as interface{} fields).
+	RuntimeChecks bool
+
+	// If true, 64-bit integers are sent as decimal strings (which JSON
+	// encoders must produce; see EncodeBigIntegers) and read as BigInts where
+	// supported, so that values beyond 2^53 keep their precision.
+	BigIntegers bool
+
+	// What to do when a map has no entry for a key, as with the missingkey
+	// option of text/template: "default" (or "invalid", or empty) prints
+	// "<no value>", "zero" uses the zero value, and "error" fails.
+	MissingKey string
+
+	// If not nil, called to describe parts of the template that may not
+	// behave the same way in JavaScript as in Go.
+	Warn func(msg string)
+
+	// Types with custom JSON encodings (such as those implementing
+	// json.Marshaler), mapped to types with the same encoding. Some types
+	// from the standard library, such as time.Time, are known already.
+	Types map[reflect.Type]reflect.Type
+
+	// If true, make the generated code easier to read, by putting each
+	// statement on its own line and keeping template comments.
+	Debug bool
+
+	// The types of the data passed to the named templates, for those that
+	// aren't included by others (and so can't be inferred; see Set).
+	Contexts map[string]reflect.Type
 }
@@ -3,7 +3,9 @@ package ast
 import (
 	"encoding/json"
 	"fmt"
-	"strconv"
+	"reflect"
+	"sort"
+	"strings"
 	"text/template/parse"
 )
 
@@ -32,21 +34,7 @@ func processPipe(n *parse.PipeNode, sc *Scope) Expression {
 			args = append(args, callee)
 		}
 
-		switch arg := c.Args[0].(type) {
-		case *parse.IdentifierNode: // {{ "foo" | func }}
-			callee = fieldOrMethod(
-				&Global{S: sc},
-				"$"+c.Args[0].(*parse.IdentifierNode).Ident,
-				args,
-			)
-		case *parse.FieldNode: // {{ "foo" | obj.method 4 }}
-			callee = processExpr(arg, sc)
-			if len(args) > 0 {
-				callee.(*Method).Args = args
-			}
-		default:
-			callee = processExpr(arg, sc)
-		}
+		callee = processCall(c.Args[0], args, sc)
 	}
 
 	if callee == nil {
@@ -59,14 +47,46 @@ func processPipe(n *parse.PipeNode, sc *Scope) Expression {
 	return callee
 }
 
+// processCall evaluates the given node, passing args to the method or
+// function it names (if any).
+func processCall(n parse.Node, args []Expression, sc *Scope) Expression {
+	var callee Expression
+	var fields []string
+
+	switch n := n.(type) {
+	case *parse.IdentifierNode: // {{ "foo" | func }}
+		return fieldOrMethod(sc, &Global{S: sc}, "$"+n.Ident, args)
+	case *parse.FieldNode: // {{ "foo" | obj.method 4 }}
+		callee, fields = &Context{T: sc.Context}, n.Ident
+	case *parse.VariableNode: // {{ "foo" | $x.method 4 }}
+		label, typ := sc.FieldNamed(n.Ident[0])
+		callee, fields = &Local{Name: label, T: typ}, n.Ident[1:]
+	case *parse.ChainNode: // {{ "foo" | (.x).method 4 }}
+		callee, fields = processExpr(n.Node, sc), n.Field
+	default:
+		if len(args) > 0 {
+			panic(fmt.Sprintf("can't give argument to non-function %s", n))
+		}
+		return processExpr(n, sc)
+	}
+
+	if len(fields) == 0 && len(args) > 0 {
+		panic(fmt.Sprintf("can't give argument to non-function %s", n))
+	}
+	for i, field := range fields {
+		if i == len(fields)-1 {
+			callee = fieldOrMethod(sc, callee, field, args)
+		} else {
+			callee = fieldOrMethod(sc, callee, field, nil)
+		}
+	}
+	return callee
+}
+
 func processExpr(n parse.Node, sc *Scope) Expression {
 	switch n := n.(type) {
 	case *parse.NumberNode:
-		value, err := strconv.ParseFloat(n.Text, 64)
-		if err != nil {
-			panic(err)
-		}
-		return &Literal{FloatVal: &value}
+		return processNumber(n, sc)
 	case *parse.StringNode:
 		return &Literal{StringVal: &n.Text}
 	case *parse.BoolNode:
@@ -75,33 +95,40 @@ func processExpr(n parse.Node, sc *Scope) Expression {
 		return processPipe(n, sc)
 	case *parse.DotNode:
 		return &Context{T: sc.Context}
-	case *parse.FieldNode:
-		callee := Expression(&Context{T: sc.Context})
-		for _, field := range n.Ident {
-			callee = fieldOrMethod(callee, field, nil)
-		}
+	case *parse.FieldNode, *parse.VariableNode, *parse.ChainNode:
+		return processCall(n, nil, sc)
+	default:
+		panic(fmt.Sprintf("unknown expr: %#v\n", n))
+	}
+}
 
-		return callee
-	case *parse.VariableNode:
-		_, typ := sc.FieldNamed(n.Ident[0])
-		callee := Expression(&Local{Name: n.Ident[0], T: typ})
-		for _, field := range n.Ident[1:] {
-			callee = fieldOrMethod(callee, field, nil)
-		}
+// processNumber types a number constant as text/template does: floats must
+// look like floats, and all other numbers are ints.
+func processNumber(n *parse.NumberNode, sc *Scope) Expression {
+	isHexInt := len(n.Text) > 2 && n.Text[0] == '0' &&
+		(n.Text[1] == 'x' || n.Text[1] == 'X') && !strings.ContainsAny(n.Text, "pP")
+	isRuneInt := n.Text[0] == '\''
 
-		return callee
-	case *parse.ChainNode:
-		callee := processExpr(n.Node, sc)
-		for _, field := range n.Field {
-			callee = fieldOrMethod(callee, field, nil)
+	switch {
+	case n.IsComplex:
+		panic(fmt.Sprintf("complex constant %s is not supported in JavaScript", n.Text))
+	case n.IsFloat && !isHexInt && !isRuneInt && strings.ContainsAny(n.Text, ".eEpP"):
+		return &Literal{FloatVal: &n.Float64}
+	case n.IsInt:
+		big := n.Int64 > maxSafeInteger || n.Int64 < -maxSafeInteger
+		if big && !sc.Options.BigIntegers {
+			sc.warn(fmt.Sprintf("constant %s loses precision in JavaScript "+
+				"(see BigIntegers)", n.Text))
 		}
-
-		return callee
+		return &Literal{IntVal: &n.Int64, Big: big && sc.Options.BigIntegers}
 	default:
-		panic(fmt.Sprintf("unknown expr: %#v\n", n))
+		panic(fmt.Sprintf("%s overflows int", n.Text))
 	}
 }
 
+// The largest integer that JavaScript can represent exactly (2^53-1).
+const maxSafeInteger = 1<<53 - 1
+
 func processStmts(ln *parse.ListNode, sc *Scope) []Statement {
 	if ln == nil {
 		return nil
@@ -121,39 +148,63 @@ func processExprCtx(n parse.Node, sc *Scope) Expression {
 
 func vToName(v *parse.VariableNode) string {
 	if len(v.Ident) != 1 {
-		panic("TODO: multi-level assignment")
+		panic(fmt.Sprintf("can't declare %s: only plain variables may be set", v))
 	}
 	return v.Ident[0]
 }
 
+// setVar declares the variable v in sc to hold values of type t or, if n
+// assigns rather than declares, checks that v (from any enclosing scope) can
+// hold them. It returns the JavaScript name of the variable.
+func setVar(n *parse.PipeNode, v string, t Type, sc *Scope) string {
+	if !n.IsAssign {
+		return sc.declare(v, t)
+	}
+	label, prev := sc.FieldNamed(v)
+	if !holds(prev, t) {
+		panic(fmt.Sprintf("can't assign %s to %s, which holds %s",
+			typeName(t, prev), v, typeName(prev, t)))
+	}
+	return label
+}
+
+// holds returns true if a variable of type v can be assigned a value of type
+// t. Unlike Go, which allows any value, this requires the same type, since
+// the variable's uses have already been type-checked.
+func holds(v, t Type) bool {
+	if _, ok := deref(v).(anything); ok {
+		return true
+	}
+	a, aok := v.(number)
+	b, bok := t.(number)
+	if aok && bok {
+		return a.integer() == b.integer() && a.Big == b.Big
+	}
+	return sameType(v, t)
+}
+
 func extractVar(n *parse.PipeNode, t Type, sc *Scope) string {
 	switch len(n.Decl) {
 	case 0:
 		return ""
 	case 1:
-		v := vToName(n.Decl[0])
-		sc.Variables[v] = t
-		return v
+		return setVar(n, vToName(n.Decl[0]), t, sc)
 	default:
-		panic("TODO: multiple assignment in if/with block")
+		panic(fmt.Sprintf("too many declarations in %s", n))
 	}
 }
 
-func extractVars(n *parse.PipeNode, t Type, sc *Scope) (index, value string) {
+func extractVars(n *parse.PipeNode, index, elem Type, sc *Scope) (string, string) {
 	switch len(n.Decl) {
 	case 0:
 		return "", ""
 	case 1:
-		b := vToName(n.Decl[0])
-		sc.Variables[b] = t
-		return "", b
+		return "", setVar(n, vToName(n.Decl[0]), elem, sc)
 	case 2:
-		a, b := vToName(n.Decl[0]), vToName(n.Decl[1])
-		sc.Variables[a] = number{}
-		sc.Variables[b] = t
-		return a, b
+		a := setVar(n, vToName(n.Decl[0]), index, sc)
+		return a, setVar(n, vToName(n.Decl[1]), elem, sc)
 	default:
-		panic("TODO: multiple assignment in if/with block")
+		panic(fmt.Sprintf("too many declarations in %s", n))
 	}
 }
 
@@ -170,8 +221,9 @@ func processStmt(n parse.Node, sc *Scope) Statement {
 			Conditional: cond,
 			SetContext:  false,
 			CondVar:     extractVar(n.Pipe, cond.typ(), sub),
+			Assign:      n.Pipe.IsAssign,
 			Body:        processStmts(n.List, sub),
-			Else:        processStmts(n.ElseList, sc),
+			Else:        processStmts(n.ElseList, sc.child()),
 			Scope:       sub,
 		}
 	case *parse.WithNode:
@@ -181,21 +233,24 @@ func processStmt(n parse.Node, sc *Scope) Statement {
 			Conditional: cond,
 			SetContext:  true,
 			CondVar:     extractVar(n.Pipe, cond.typ(), sub),
+			Assign:      n.Pipe.IsAssign,
 			Body:        processStmts(n.List, sub),
-			Else:        processStmts(n.ElseList, sc),
+			Else:        processStmts(n.ElseList, sc.child()),
 			Scope:       sub,
 		}
 	case *parse.RangeNode:
 		sub := sc.child()
-		subj := processExprCtx(n.Pipe, sub)
-		sub.Context = sub.Context.Iterate()
-		index, value := extractVars(n.Pipe, subj.typ().Iterate(), sub)
+		subj := processExpr(n.Pipe, sub)
+		indexType, elemType := rangeTypes(subj.typ(), len(n.Pipe.Decl))
+		sub.Context = elemType
+		index, value := extractVars(n.Pipe, indexType, elemType, sub)
 		return &Loop{
 			Subject:  subj,
 			Body:     processStmts(n.List, sub),
-			Else:     processStmts(n.ElseList, sc),
+			Else:     processStmts(n.ElseList, sc.child()),
 			IndexVar: index,
 			ValueVar: value,
+			Assign:   n.Pipe.IsAssign,
 			Scope:    sub,
 		}
 	case *parse.ActionNode:
@@ -204,16 +259,30 @@ func processStmt(n parse.Node, sc *Scope) Statement {
 			return &Append{processExpr(n.Pipe, sc)}
 		case 1:
 			inside := processExpr(n.Pipe, sc)
-			extractVar(n.Pipe, inside.typ(), sc)
-			return &SetLocal{n.Pipe.Decl[0].Ident[0], inside}
+			name := extractVar(n.Pipe, inside.typ(), sc)
+			return &SetLocal{Name: name, Value: inside, Assign: n.Pipe.IsAssign}
 		default:
-			panic("TODO: multiple assignment?")
+			panic(fmt.Sprintf("too many declarations in %s", n))
 		}
+	case *parse.CommentNode:
+		if !sc.Options.Debug {
+			return &Comment{}
+		}
+		text := strings.TrimSuffix(strings.TrimPrefix(n.Text, "/*"), "*/")
+		return &Comment{Text: strings.TrimSpace(text)}
+	case *parse.BreakNode:
+		return &Break{}
+	case *parse.ContinueNode:
+		return &Continue{}
 	case *parse.TemplateNode:
-		return &Include{
+		include := &Include{
 			Name:    n.Name,
 			Context: processExpr(n.Pipe, sc),
 		}
+		if sc.set != nil {
+			sc.set.include(n.Name, include.Context)
+		}
+		return include
 	default:
 		panic(fmt.Sprintf("unknown stmt: %#v\n", n))
 	}
@@ -233,6 +302,121 @@ func Process(t *parse.Tree, sc *Scope) (r string, err error) {
 		}
 	}()
 
-	r = catStmts(processStmts(t.Root, sc))
+	r = sc.catStmts(processStmts(t.Root, sc))
 	return
 }
+
+// include records that the named template is executed with the value of
+// ctx (or no data, if nil), whose type must agree with the other places that
+// include it.
+func (s *Set) include(name string, ctx Expression) {
+	if s.Trees[name] == nil {
+		panic(fmt.Sprintf("no such template %q", name))
+	}
+	t := Type(nothing{})
+	if ctx != nil {
+		t = ctx.typ()
+	}
+	prev, ok := s.Contexts[name]
+	if !ok {
+		s.Contexts[name] = t
+		s.queue = append(s.queue, name)
+	} else if _, any := deref(prev).(anything); !any && !sameType(prev, t) {
+		panic(fmt.Sprintf("template %q is executed with %s, but elsewhere with %s",
+			name, typeName(t, prev), typeName(prev, t)))
+	}
+}
+
+// sameType returns true if a and b are the same type, ignoring pointers
+// (which text/template dereferences as needed).
+func sameType(a, b Type) bool {
+	return equalTypes(deref(a), deref(b))
+}
+
+// equalTypes returns true if a and b are the same type. Objects of the same
+// Go struct type are equal even if only one is addressable (and so has the
+// methods of the pointer type).
+func equalTypes(a, b Type) bool {
+	switch a := a.(type) {
+	case *object:
+		if b, ok := b.(*object); ok && a.Type != nil && b.Type != nil {
+			return a.Type == b.Type
+		}
+	case array:
+		b, ok := b.(array)
+		return ok && equalTypes(a.Contains, b.Contains)
+	case pointer:
+		b, ok := b.(pointer)
+		return ok && equalTypes(a.Elem, b.Elem)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// typeName returns the name of t for error messages, qualified by its package
+// if that is needed to tell it apart from other.
+func typeName(t, other Type) string {
+	name := fmt.Sprint(t)
+	if o, ok := deref(t).(*object); ok && o.Type != nil && name == fmt.Sprint(other) {
+		return o.Type.PkgPath() + "." + name
+	}
+	return name
+}
+
+// Process converts each template in the set into a JavaScript string, indexed
+// by name. Templates are converted in the order they are reached from those
+// in s.Contexts, so that the types of their data are known.
+func (s *Set) Process() (map[string]string, error) {
+	names := make([]string, 0, len(s.Trees))
+	for name := range s.Trees {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, ok := s.Contexts[name]; ok {
+			s.queue = append(s.queue, name)
+		}
+	}
+
+	// First convert everything reachable from the templates whose types are
+	// known; nothing includes the templates left, so they use the default.
+	code := map[string]string{}
+	if err := s.drain(code); err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if _, ok := s.Contexts[name]; !ok {
+			s.Contexts[name] = s.Default
+			s.queue = append(s.queue, name)
+			if err := s.drain(code); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return code, nil
+}
+
+// drain converts the templates in the queue, and those they include, into
+// code.
+func (s *Set) drain(code map[string]string) error {
+	for len(s.queue) > 0 {
+		next := s.queue[0]
+		s.queue = s.queue[1:]
+		if _, ok := code[next]; ok {
+			continue
+		}
+
+		sc := NewScope(s.Contexts[next])
+		sc.Options = s.Options
+		sc.set = s
+		for key, typ := range s.Funcs {
+			sc.Funcs["$"+key] = typ
+		}
+		js, err := Process(s.Trees[next], sc)
+		if err != nil {
+			return err
+		}
+		code[next] = js
+	}
+	return nil
+}
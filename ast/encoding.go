@@ -0,0 +1,290 @@
+package ast
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+)
+
+var (
+	// The types in the standard library with custom JSON encodings, mapped
+	// to types with the same encoding (see Options.Types).
+	stdlibTypes = map[reflect.Type]reflect.Type{
+		reflect.TypeOf(time.Time{}):       reflect.TypeOf(""),
+		reflect.TypeOf(json.Number("")):   reflect.TypeOf(float64(0)),
+		reflect.TypeOf(json.RawMessage{}): reflect.TypeOf((*interface{})(nil)).Elem(),
+		reflect.TypeOf(big.Int{}):         reflect.TypeOf(int64(0)),
+	}
+
+	marshalerType     = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// customEncoding returns the type with the same JSON encoding as t, if t has
+// a custom encoding; values with an unknown encoding are typed as interface{}.
+func (o *Options) customEncoding(t reflect.Type) (reflect.Type, bool) {
+	repr, ok := o.Types[t]
+	if !ok {
+		repr, ok = stdlibTypes[t]
+	}
+
+	switch {
+	case ok:
+		return repr, true
+	case t.Kind() == reflect.Ptr || t.Kind() == reflect.Interface:
+		return nil, false
+	case implements(t, marshalerType):
+		return reflect.TypeOf((*interface{})(nil)).Elem(), true
+	case implements(t, textMarshalerType):
+		return reflect.TypeOf(""), true
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8 &&
+		!implements(t.Elem(), marshalerType) && !implements(t.Elem(), textMarshalerType):
+		return reflect.TypeOf(""), true // encoded as base64
+	}
+	return nil, false
+}
+
+// implements returns true if t (or, as encoding/json allows for addressable
+// values, *t) implements the interface iface.
+func implements(t, iface reflect.Type) bool {
+	return t.Implements(iface) || reflect.PtrTo(t).Implements(iface)
+}
+
+// A jsonField describes how encoding/json represents a struct field.
+type jsonField struct {
+	// The key of the field in the JSON object.
+	Label string
+
+	// If true, the field is left out when it has its zero value.
+	OmitEmpty bool
+
+	// If true, the value is itself JSON-encoded into a string (`json:",string"`).
+	Quoted bool
+
+	// If true, the field is an embedded struct whose fields are promoted
+	// into the enclosing JSON object.
+	Inline bool
+
+	index []int
+	tag   bool
+	typ   reflect.Type
+}
+
+// jsonFields returns the fields of the given struct type that encoding/json
+// would encode, keyed by their index sequence (see pathKey).
+//
+// This follows the rules of typeFields in encoding/json, including the
+// promotion of fields from embedded structs and the resolution of conflicts.
+func jsonFields(t reflect.Type) map[string]jsonField {
+	current := []jsonField{}
+	next := []jsonField{{typ: t}}
+
+	var count, nextCount map[reflect.Type]int
+	visited := map[reflect.Type]bool{}
+	var fields []jsonField
+
+	for len(next) > 0 {
+		current, next = next, current[:0]
+		count, nextCount = nextCount, map[reflect.Type]int{}
+
+		for _, f := range current {
+			if visited[f.typ] {
+				continue
+			}
+			visited[f.typ] = true
+
+			for i := 0; i < f.typ.NumField(); i++ {
+				sf := f.typ.Field(i)
+				if sf.Anonymous {
+					t := sf.Type
+					if t.Kind() == reflect.Ptr {
+						t = t.Elem()
+					}
+					if sf.PkgPath != "" && t.Kind() != reflect.Struct {
+						continue
+					}
+				} else if sf.PkgPath != "" {
+					continue
+				}
+
+				tag := sf.Tag.Get("json")
+				if tag == "-" {
+					continue
+				}
+				name, opts := parseTag(tag)
+				if !isValidTag(name) {
+					name = ""
+				}
+				index := make([]int, len(f.index)+1)
+				copy(index, f.index)
+				index[len(f.index)] = i
+
+				ft := sf.Type
+				if ft.Name() == "" && ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+
+				quoted := false
+				if hasOption(opts, "string") {
+					switch ft.Kind() {
+					case reflect.Bool,
+						reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+						reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+						reflect.Float32, reflect.Float64,
+						reflect.String:
+						quoted = true
+					}
+				}
+
+				if name != "" || !sf.Anonymous || ft.Kind() != reflect.Struct {
+					tagged := name != ""
+					if name == "" {
+						name = sf.Name
+					}
+					field := jsonField{
+						Label:     name,
+						OmitEmpty: hasOption(opts, "omitempty") || hasOption(opts, "omitzero"),
+						Quoted:    quoted,
+						index:     index,
+						tag:       tagged,
+					}
+					fields = append(fields, field)
+					if count[f.typ] > 1 {
+						// Duplicate the field, so that it is annihilated below.
+						fields = append(fields, field)
+					}
+					continue
+				}
+
+				nextCount[ft]++
+				if nextCount[ft] == 1 {
+					next = append(next, jsonField{Label: ft.Name(), index: index, typ: ft})
+				}
+			}
+		}
+	}
+
+	sort.Slice(fields, func(i, j int) bool {
+		a, b := fields[i], fields[j]
+		if a.Label != b.Label {
+			return a.Label < b.Label
+		}
+		if len(a.index) != len(b.index) {
+			return len(a.index) < len(b.index)
+		}
+		if a.tag != b.tag {
+			return a.tag
+		}
+		for k := range a.index {
+			if a.index[k] != b.index[k] {
+				return a.index[k] < b.index[k]
+			}
+		}
+		return false
+	})
+
+	// Keep only the dominant field of each name; ties at the same depth
+	// (with the same taggedness) are dropped entirely.
+	result := map[string]jsonField{}
+	for advance, i := 0, 0; i < len(fields); i += advance {
+		for advance = 1; i+advance < len(fields); advance++ {
+			if fields[i+advance].Label != fields[i].Label {
+				break
+			}
+		}
+		if advance > 1 && len(fields[i].index) == len(fields[i+1].index) &&
+			fields[i].tag == fields[i+1].tag {
+			continue
+		}
+		result[pathKey(fields[i].index)] = fields[i]
+	}
+	return result
+}
+
+// pathKey formats an index sequence (as in reflect.StructField.Index).
+func pathKey(index []int) string {
+	return strings.Trim(fmt.Sprint(index), "[]")
+}
+
+func parseTag(tag string) (string, string) {
+	if i := strings.Index(tag, ","); i >= 0 {
+		return tag[:i], tag[i+1:]
+	}
+	return tag, ""
+}
+
+func hasOption(opts, name string) bool {
+	for _, opt := range strings.Split(opts, ",") {
+		if opt == name {
+			return true
+		}
+	}
+	return false
+}
+
+func isValidTag(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case strings.ContainsRune("!#$%&()*+-./:;<=>?@[]^_{|}~ ", c):
+		case !unicode.IsLetter(c) && !unicode.IsDigit(c):
+			return false
+		}
+	}
+	return true
+}
+
+// EncodeBigIntegers rewrites data, the generic JSON form of a value of type t
+// (as decoded with json.Decoder.UseNumber), so that the integers that need
+// BigInts are decimal strings.
+func EncodeBigIntegers(t Type, data interface{}) interface{} {
+	switch t := t.(type) {
+	case number:
+		if n, ok := data.(json.Number); ok && t.Big {
+			return n.String()
+		}
+	case array:
+		if items, ok := data.([]interface{}); ok {
+			for i, item := range items {
+				items[i] = EncodeBigIntegers(t.Contains, item)
+			}
+		}
+	case pointer:
+		return EncodeBigIntegers(t.Elem, data)
+	case mapping:
+		if fields, ok := data.(map[string]interface{}); ok {
+			for key, value := range fields {
+				fields[key] = EncodeBigIntegers(t.Elem, value)
+			}
+		}
+	case *object:
+		if fields, ok := data.(map[string]interface{}); ok {
+			t.encodeBigIntegers(fields)
+		}
+	}
+	return data
+}
+
+func (o *object) encodeBigIntegers(fields map[string]interface{}) {
+	for name, typ := range o.Fields {
+		field, ok := o.JSON[name]
+		switch {
+		case !ok || field.Quoted:
+			// Either not sent at all, or already a string.
+		case field.Inline:
+			typ.(*object).encodeBigIntegers(fields)
+		default:
+			if value, ok := fields[field.Label]; ok {
+				fields[field.Label] = EncodeBigIntegers(typ, value)
+			}
+		}
+	}
+}
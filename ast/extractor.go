@@ -3,136 +3,323 @@ package ast
 import (
 	"fmt"
 	"reflect"
-	"strings"
 )
 
-func newMethod(recv bool, t reflect.Type) Type {
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// A typeCache remembers the Types of the structs seen so far, so that
+// recursive types (such as trees) are only constructed once.
+type typeCache struct {
+	types   map[typeKey]Type
+	options *Options
+}
+
+// A typeKey identifies a Go type, and whether values of that type are
+// addressable (and so also have the methods of the pointer type).
+type typeKey struct {
+	t    reflect.Type
+	addr bool
+}
+
+func (c typeCache) newMethod(recv bool, t reflect.Type) Type {
 	i := 0
 	if recv {
 		i = 1
 	}
 
-	f := function{Args: []Type{}, Return: nil}
+	f := function{Args: []Type{}, Return: nil, Variadic: t.IsVariadic(), Method: recv}
 	for ; i < t.NumIn(); i++ {
-		f.Args = append(f.Args, NewType(t.In(i)))
+		in := t.In(i)
+		if f.Variadic && i == t.NumIn()-1 {
+			in = in.Elem()
+		}
+		f.Args = append(f.Args, c.newType(in, false))
 	}
 
-	switch t.NumOut() {
-	case 0:
-	case 1:
-		f.Return = NewType(t.Out(0))
+	switch {
+	case t.NumOut() == 0:
+	case t.NumOut() == 1:
+		f.Return = c.newType(t.Out(0), false)
+	case t.NumOut() == 2 && t.Out(1) == errorType:
+		f.Return = c.newType(t.Out(0), false)
+		f.Error = true
 	default:
-		panic("TODO: cannot handle non-singular return values")
+		panic(fmt.Sprintf("cannot handle return values of %s", t))
 	}
 
 	return f
 }
 
+// newObject creates the Type of the struct t, found by following the index
+// sequence prefix (through the structs outer) from the struct whose
+// encoding/json fields are enc.
+func (c typeCache) newObject(t reflect.Type, addr bool, enc map[string]jsonField, prefix []int, outer []reflect.Type) *object {
+	o := &object{
+		Name:   t.Name(),
+		Fields: map[string]Type{},
+		JSON:   map[string]jsonField{},
+	}
+	if len(prefix) == 0 {
+		o.Type = t
+		c.types[typeKey{t, addr}] = o
+	}
+	outer = append(outer, t)
+
+	// Include fields promoted from embedded structs, skipping ambiguous
+	// selectors as Go does.
+	for _, f := range reflect.VisibleFields(t) {
+		if f.PkgPath != "" {
+			continue // unexported fields are inaccessible from templates
+		}
+		if found, ok := t.FieldByName(f.Name); !ok || !sameIndex(found.Index, f.Index) {
+			continue
+		}
+		index := append(append([]int{}, prefix...), f.Index...)
+		field, encoded := enc[pathKey(index)]
+		inner := embeddedStruct(f)
+		fieldAddr := addr || throughPointer(t, f.Index)
+
+		switch {
+		case encoded:
+			o.Fields[f.Name] = c.newType(f.Type, fieldAddr)
+			o.JSON[f.Name] = field
+		case inner != nil && !containsType(outer, inner):
+			o.Fields[f.Name] = c.newObject(inner, fieldAddr || f.Type.Kind() == reflect.Ptr,
+				enc, index, outer)
+			o.JSON[f.Name] = jsonField{Inline: true}
+		default:
+			o.Fields[f.Name] = c.newType(f.Type, fieldAddr)
+		}
+	}
+
+	// As in text/template, addressable values also have the methods
+	// declared on their pointer type.
+	methods := t
+	if addr {
+		methods = reflect.PtrTo(t)
+	}
+	for i := 0; i < methods.NumMethod(); i++ {
+		m := methods.Method(i)
+		o.Fields[m.Name] = c.newMethod(true, m.Type)
+	}
+	return o
+}
+
+// throughPointer returns true if the field of t with the given index sequence
+// is promoted through an embedded pointer.
+func throughPointer(t reflect.Type, index []int) bool {
+	for _, i := range index[:len(index)-1] {
+		t = t.Field(i).Type
+		if t.Kind() == reflect.Ptr {
+			return true
+		}
+	}
+	return false
+}
+
+// embeddedStruct returns the struct type of f if encoding/json promotes its
+// fields into the enclosing object, or nil otherwise.
+func embeddedStruct(f reflect.StructField) reflect.Type {
+	tag := f.Tag.Get("json")
+	if name, _ := parseTag(tag); !f.Anonymous || tag == "-" || isValidTag(name) {
+		return nil
+	}
+	t := f.Type
+	if t.Name() == "" && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	return t
+}
+
+func sameIndex(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func containsType(types []reflect.Type, t reflect.Type) bool {
+	for _, other := range types {
+		if other == t {
+			return true
+		}
+	}
+	return false
+}
+
 // NewType creates a Type from a reflect.Type.
 func NewType(t reflect.Type) Type {
+	return (&Options{}).NewType(t)
+}
+
+// NewType creates a Type from a reflect.Type, as it is represented when
+// using these options.
+func (o *Options) NewType(t reflect.Type) Type {
+	return typeCache{types: map[typeKey]Type{}, options: o}.newType(t, false)
+}
+
+// newType creates a Type from a reflect.Type; addr is true if values of the
+// type are addressable, according to the rules of reflect.Value.CanAddr.
+func (c typeCache) newType(t reflect.Type, addr bool) Type {
+	if typ, ok := c.types[typeKey{t, addr}]; ok {
+		return typ
+	}
+	if repr, ok := c.options.customEncoding(t); ok {
+		return c.newType(repr, addr)
+	}
+
 	switch t.Kind() {
 	case reflect.Ptr:
-		return NewType(t.Elem())
+		return pointer{Elem: c.newType(t.Elem(), true)}
 	case reflect.Bool:
 		return boolean{}
+	case reflect.Int64, reflect.Uint64:
+		return number{Kind: t.Kind(), Big: c.options.BigIntegers}
 	case reflect.Int,
-		reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
-		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
 		reflect.Uintptr, reflect.Float32, reflect.Float64:
-		return number{}
-	case reflect.Array, reflect.Slice:
-		return array{Contains: NewType(t.Elem())}
+		return number{Kind: t.Kind()}
+	case reflect.Array:
+		return array{Contains: c.newType(t.Elem(), addr)}
+	case reflect.Slice:
+		return array{Contains: c.newType(t.Elem(), true)}
+	case reflect.Map:
+		// As in encoding/json, keys are strings, integers, or TextMarshalers
+		// (which are encoded as strings).
+		var key Type
+		switch kind := t.Key().Kind(); {
+		case kind == reflect.String || implements(t.Key(), textMarshalerType):
+			key = str{}
+		case kind >= reflect.Int && kind <= reflect.Uintptr:
+			key = c.newType(t.Key(), false)
+		default:
+			panic(fmt.Sprintf("cannot process type %s", t))
+		}
+		return mapping{Key: key, Elem: c.newType(t.Elem(), false)}
 	case reflect.String:
 		return str{}
 	case reflect.Struct:
-		o := &object{
-			Fields: map[string]Type{},
-			Labels: map[string]string{},
-		}
-		for i := 0; i < t.NumField(); i++ {
-			f := t.Field(i)
-			o.Fields[f.Name] = NewType(f.Type)
-
-			// Extract `json:"value"` struct tag
-			tag := f.Tag.Get("json")
-			i := strings.Index(tag, ",")
-			if i < 0 {
-				i = len(tag)
-			}
-			if tag != "" {
-				o.Labels[f.Name] = tag[:i]
-			}
-		}
-
-		for i := 0; i < t.NumMethod(); i++ {
-			m := t.Method(i)
-			o.Fields[m.Name] = newMethod(true, m.Type)
-		}
-		return o
+		return c.newObject(t, addr, jsonFields(t), nil, nil)
 	case reflect.Func:
-		return newMethod(false, t)
+		switch yield := yieldFunc(t); {
+		case yield == nil:
+		case yield.NumIn() == 1:
+			return iterator{Elem: c.newType(yield.In(0), false)}
+		case yield.NumIn() == 2:
+			return iterator{Key: c.newType(yield.In(0), false), Elem: c.newType(yield.In(1), false)}
+		}
+		return c.newMethod(false, t)
+	case reflect.Interface:
+		return anything{}
 	default:
 		panic(fmt.Sprintf("cannot process type %s", t))
 	}
 }
 
+// yieldFunc returns the type of the yield callback if the function type t is
+// an iterator (such as iter.Seq or iter.Seq2), or nil otherwise.
+func yieldFunc(t reflect.Type) reflect.Type {
+	if t.NumIn() != 1 || t.NumOut() != 0 || t.IsVariadic() {
+		return nil
+	}
+	yield := t.In(0)
+	if yield.Kind() != reflect.Func || yield.IsVariadic() || yield.NumIn() > 2 ||
+		yield.NumOut() != 1 || yield.Out(0).Kind() != reflect.Bool {
+		return nil
+	}
+	return yield
+}
+
 // NewScope creates a global template context ready for the given root object.
 // (Primarily, this means setting things like $ and lt).
+//
+// The root object itself is assumed not to be nil.
 func NewScope(ctx Type) *Scope {
+	if p, ok := ctx.(pointer); ok {
+		ctx = p.Elem
+	}
 	return &Scope{
-		Context: ctx,
-		Variables: map[string]Type{
-			"$": ctx,
-			"$lt": function{
-				Args:   []Type{number{}, number{}},
-				Return: boolean{},
-			},
-			"$le": function{
-				Args:   []Type{number{}, number{}},
-				Return: boolean{},
-			},
-			"$ne": function{
-				Args:   []Type{number{}, number{}},
-				Return: boolean{},
-			},
-			"$gt": function{
-				Args:   []Type{number{}, number{}},
-				Return: boolean{},
-			},
-			"$ge": function{
-				Args:   []Type{number{}, number{}},
-				Return: boolean{},
-			},
-			"$eq": function{
-				Args:   []Type{number{}, number{}},
-				Return: boolean{},
-			},
+		Context:   ctx,
+		Options:   &Options{},
+		Variables: map[string]Type{"$": ctx},
+		labels:    map[string]string{},
+		declared:  map[string]int{"$": 1},
+		Funcs: map[string]Type{
+			"$call": caller{},
+			"$lt":   comparison{Op: "lt"},
+			"$le":   comparison{Op: "le"},
+			"$ne":   comparison{Op: "ne"},
+			"$gt":   comparison{Op: "gt"},
+			"$ge":   comparison{Op: "ge"},
+			"$eq":   comparison{Op: "eq"},
 			"$printf": function{
-				Args:   []Type{str{}, str{}},
-				Return: str{},
+				Args:     []Type{str{}, anything{}},
+				Variadic: true,
+				Return:   str{},
+				Formats:  true,
 			},
 			"$_html_template_htmlescaper": function{
-				Args:   []Type{str{}},
-				Return: str{},
+				Args:     []Type{anything{}},
+				Variadic: true,
+				Return:   str{},
+				Formats:  true,
 			},
 			"$_html_template_urlescaper": function{
-				Args:   []Type{str{}},
-				Return: str{},
+				Args:     []Type{anything{}},
+				Variadic: true,
+				Return:   str{},
+				Formats:  true,
 			},
 			"$_html_template_attrescaper": function{
-				Args:   []Type{str{}},
-				Return: str{},
+				Args:     []Type{anything{}},
+				Variadic: true,
+				Return:   str{},
+				Formats:  true,
 			},
 			"$_html_template_jsvalescaper": function{
-				Args:   []Type{str{}},
-				Return: str{},
+				Args:     []Type{anything{}},
+				Variadic: true,
+				Return:   str{},
+				Formats:  true,
 			},
 			"$_html_template_jsstrescaper": function{
-				Args:   []Type{str{}},
-				Return: str{},
+				Args:     []Type{anything{}},
+				Variadic: true,
+				Return:   str{},
+				Formats:  true,
+			},
+			"$html": function{
+				Args:     []Type{anything{}},
+				Variadic: true,
+				Return:   str{},
+				Formats:  true,
+				Sprint:   true,
+			},
+			"$js": function{
+				Args:     []Type{anything{}},
+				Variadic: true,
+				Return:   str{},
+				Formats:  true,
+				Sprint:   true,
+			},
+			"$urlquery": function{
+				Args:     []Type{anything{}},
+				Variadic: true,
+				Return:   str{},
+				Formats:  true,
+				Sprint:   true,
 			},
 			"$json": function{
-				Args:   []Type{str{}},
+				Args:   []Type{anything{}},
 				Return: str{},
 			},
 		},
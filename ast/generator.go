@@ -2,11 +2,19 @@ package ast
 
 import (
 	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 func (l *Literal) expr() string {
-	if l.FloatVal != nil {
-		return fmt.Sprintf("%f", *l.FloatVal)
+	if l.IntVal != nil && l.Big {
+		return fmt.Sprintf("$.$big(\"%d\")", *l.IntVal)
+	} else if l.IntVal != nil {
+		return strconv.FormatInt(*l.IntVal, 10)
+	} else if l.FloatVal != nil {
+		return strconv.FormatFloat(*l.FloatVal, 'g', -1, 64)
 	} else if l.BoolVal != nil {
 		if *l.BoolVal {
 			return "true"
@@ -16,21 +24,204 @@ func (l *Literal) expr() string {
 	return quote(*l.StringVal)
 }
 func (f Method) expr() string {
-	lbl, _ := f.Subject.typ().FieldNamed(f.Name)
-	res := fmt.Sprintf("%s.%s(", f.Subject.expr(), lbl)
+	lbl, typ := f.Subject.typ().FieldNamed(f.Name)
+	fn := typ.(function)
+	args := ""
 	for i, arg := range f.Args {
 		if i != 0 {
-			res += ", "
+			args += ", "
+		}
+		if fn.Sprint {
+			args += format(arg)
+		} else if fn.Formats {
+			args += formatArg(arg)
+		} else {
+			args += arg.expr()
 		}
-		res += arg.expr()
 	}
-	res += ")"
-	return res
+	if fn.Sprint {
+		args = fmt.Sprintf("$.$sprint([%s], %s)", args, quote(sprintKinds(f.Args)))
+	}
+	if fn.Error {
+		return fmt.Sprintf("$.$invoke(%s, %s, %s, [%s])",
+			quote(strings.TrimPrefix(f.Name, "$")), receiver(f.Subject, f.Name), quote(lbl), args)
+	}
+	return fmt.Sprintf("%s(%s)", property(receiver(f.Subject, f.Name), lbl), args)
+}
+
+// sprintKinds describes args for $.$sprint, which (as fmt.Sprint) adds
+// spaces between operands when neither is a string: "s" is a string, "*" is
+// only known at runtime, and "-" is anything else.
+func sprintKinds(args []Expression) string {
+	kinds := ""
+	for _, arg := range args {
+		switch deref(arg.typ()).(type) {
+		case str:
+			kinds += "s"
+		case anything:
+			kinds += "*"
+		default:
+			kinds += "-"
+		}
+	}
+	return kinds
+}
+
+func (d Dynamic) expr() string {
+	args := ""
+	for i, arg := range d.Args {
+		if i != 0 {
+			args += ", "
+		}
+		args += arg.expr()
+	}
+	if d.Checked {
+		return fmt.Sprintf("$.$dynamic(%s, %s, [%s], true)", d.Subject.expr(), quote(d.Name), args)
+	}
+	return fmt.Sprintf("$.$dynamic(%s, %s, [%s])", d.Subject.expr(), quote(d.Name), args)
+}
+
+func (c Compare) expr() string {
+	// Since BigInts can't be compared with Numbers, all integers are BigInts
+	// if any are.
+	big := false
+	for _, arg := range c.Args {
+		if n, ok := arg.typ().(number); ok && n.Big {
+			big = true
+		}
+	}
+
+	args := ""
+	for i, arg := range c.Args {
+		if i != 0 {
+			args += ", "
+		}
+		if _, ok := arg.typ().(number); ok && big {
+			args += fmt.Sprintf("$.$bigint(%s)", arg.expr())
+		} else {
+			args += arg.expr()
+		}
+	}
+
+	// As in Go, gt and ge are the inverse of le and lt.
+	switch c.Op {
+	case "ne":
+		return fmt.Sprintf("!$.$eq(%s)", args)
+	case "gt":
+		return fmt.Sprintf("!$.$le(%s)", args)
+	case "ge":
+		return fmt.Sprintf("!$.$lt(%s)", args)
+	}
+	return fmt.Sprintf("$.$%s(%s)", c.Op, args)
+}
+
+func (c Call) expr() string {
+	args := ""
+	for i, arg := range c.Args {
+		if i != 0 {
+			args += ", "
+		}
+		args += arg.expr()
+	}
+	return fmt.Sprintf("$.$call(%s, [%s])", c.Func.expr(), args)
 }
 
 func (f Field) expr() string {
-	lbl, _ := f.Subject.typ().FieldNamed(f.Name)
-	return fmt.Sprintf("%s.%s", f.Subject.expr(), lbl)
+	lbl, typ := f.Subject.typ().FieldNamed(f.Name)
+	subj := receiver(f.Subject, f.Name)
+
+	var res string
+	switch t := deref(f.Subject.typ()).(type) {
+	case mapping:
+		switch f.MissingKey {
+		case "zero":
+			res = fmt.Sprintf("$.$key(%s, %s, \"zero\", %s)", subj, quote(lbl), zero(t.Elem))
+		case "error":
+			res = fmt.Sprintf("$.$key(%s, %s, \"error\")", subj, quote(lbl))
+		default:
+			res = fmt.Sprintf("$.$key(%s, %s)", subj, quote(lbl))
+		}
+	case *object:
+		field := t.JSON[f.Name]
+		if field.Inline {
+			// The fields of embedded structs are part of the same JSON object.
+			return subj
+		}
+		res = property(subj, lbl)
+		if field.Quoted {
+			res = fmt.Sprintf("$.$unquote(%s)", res)
+		}
+		if field.OmitEmpty {
+			res = fmt.Sprintf("$.$default(%s, %s)", res, zero(typ))
+		}
+	default:
+		return property(subj, lbl)
+	}
+
+	if n, ok := typ.(number); ok && n.Big {
+		res = fmt.Sprintf("$.$big(%s)", res)
+	}
+	return res
+}
+
+// receiver returns code for the subject of a field or method, which raises
+// an error (as Go does) if it is a nil pointer.
+func receiver(subject Expression, name string) string {
+	if p, ok := subject.typ().(pointer); ok {
+		return fmt.Sprintf("$.$deref(%s, %s)", subject.expr(), quote(p.String()+"."+name))
+	}
+	return subject.expr()
+}
+
+// property returns code to access the given property of subject.
+func property(subject, name string) string {
+	if identifier.MatchString(name) {
+		return subject + "." + name
+	}
+	return subject + "[" + quote(name) + "]"
+}
+
+var identifier = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*$`)
+
+// zero returns the JavaScript value of the Go zero value of the given type.
+func zero(t Type) string {
+	switch t := t.(type) {
+	case str:
+		return `""`
+	case number:
+		return "0"
+	case boolean:
+		return "false"
+	case *object:
+		// Structs are only left out by omitzero, or missing from maps.
+		return "{" + strings.Join(zeroFields(t), ",") + "}"
+	default:
+		return "null"
+	}
+}
+
+// zeroFields returns the properties of the zero value of o, as encoding/json
+// encodes it, in sorted order.
+func zeroFields(o *object) []string {
+	names := make([]string, 0, len(o.JSON))
+	for name := range o.JSON {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	props := []string{}
+	for _, name := range names {
+		field := o.JSON[name]
+		switch {
+		case field.Inline:
+			props = append(props, zeroFields(o.Fields[name].(*object))...)
+		case field.Quoted:
+			props = append(props, quote(field.Label)+":"+quote(zero(o.Fields[name])))
+		default:
+			props = append(props, quote(field.Label)+":"+zero(o.Fields[name]))
+		}
+	}
+	return props
 }
 
 func (l Local) expr() string {
@@ -42,6 +233,9 @@ func (c Context) expr() string { return "ctx" }
 func (g Global) expr() string { return "$" }
 
 func (sl SetLocal) stmt() string {
+	if sl.Assign {
+		return fmt.Sprintf("%s=%s;", sl.Name, sl.Value.expr())
+	}
 	return fmt.Sprintf("var %s=%s;", sl.Name, sl.Value.expr())
 }
 
@@ -49,22 +243,149 @@ func (t Text) stmt() string {
 	return fmt.Sprintf("out+=%s;", quote(t.Text))
 }
 
-func (e Append) stmt() string { return "out+=" + e.Expression.expr() + ";" }
+func (e Append) stmt() string { return "out+=" + format(e.Expression) + ";" }
+
+// format returns code to convert e to text as Go would, where that differs
+// from JavaScript (for instance, Go prints 1e6 as "1e+06", nil slices as
+// "[]", and nil interfaces as "<no value>").
+func format(e Expression) string {
+	return printed(e, "<no value>", "")
+}
+
+// formatArg is like format, but for the arguments of functions such as the
+// html/template escapers, which print nothing for missing values and nil
+// interfaces.
+func formatArg(e Expression) string {
+	return printed(e, "", `, ""`)
+}
+
+func printed(e Expression, nilInterface string, missing string) string {
+	res := e.expr()
+
+	nilText := "<nil>"
+	_, nullable := e.typ().(pointer)
+	switch deref(e.typ()).(type) {
+	case array:
+		nilText, nullable = "[]", true
+	case mapping:
+		nilText, nullable = "map[]", true
+	case anything:
+		nilText, nullable = nilInterface, true
+	case nothing:
+		nullable = true
+	}
+	if nullable || mayBeMissing(e) {
+		res = fmt.Sprintf("$.$print(%s, %s%s)", res, quote(nilText), missing)
+	}
+
+	if n, ok := deref(e.typ()).(number); ok && !n.integer() {
+		res = fmt.Sprintf("$.$float(%s)", res)
+	}
+	return res
+}
+
+// mayBeMissing returns true if e looks up a key in a map, and so may have no
+// value at all.
+func mayBeMissing(e Expression) bool {
+	f, ok := e.(*Field)
+	if !ok || f.MissingKey == "zero" {
+		return false
+	}
+	_, ok = deref(f.Subject.typ()).(mapping)
+	return ok
+}
+
+// truth returns code to test whether v is true, as Go defines it: empty
+// slices and maps are false, as are nil pointers and zero values.
+func truth(t Type) string {
+	switch deref(t).(type) {
+	case mapping:
+		return "$.$truth(v,true)"
+	case array, anything:
+		return "$.$truth(v)"
+	}
+	return "v"
+}
 
 func (l Loop) stmt() string {
-	sv := ""
+	index, elem, length, keys := "i", "it[i]", "it.length", ""
+	seq, isSeq := deref(l.Subject.typ()).(iterator)
+	switch m := deref(l.Subject.typ()).(type) {
+	case number:
+		// As in Go, ranging over n visits 0 to n-1.
+		elem, length = "i", "it"
+	case iterator:
+		// The body is called with each key and element (a, b), or element (a).
+		elem = "a"
+		if m.Key != nil && l.IndexVar != "" {
+			index, elem = "a", "b"
+		}
+	case anything:
+		// Arrays, objects (as maps) and integers are told apart at runtime.
+		index, elem, length = "it.k[i]", "it.v[i]", "it.k.length"
+	case mapping:
+		// As in Go, maps are visited in the order of their sorted keys.
+		index, elem, length = "ks[i]", "it[ks[i]]", "ks.length"
+		if n, ok := m.Key.(number); ok {
+			index = "+ks[i]"
+			if n.Big {
+				index = "$.$big(ks[i])"
+			}
+		}
+		_, numeric := m.Key.(number)
+		keys = fmt.Sprintf("var ks=$.$keys(it,%t);", numeric)
+	}
+	if n, ok := l.Subject.typ().Iterate().(number); ok && n.Big && !isSeq {
+		elem = "$.$big(" + elem + ")"
+	}
+
+	// Variables are declared as parameters of the closure for each
+	// iteration; since it is a closure, assigning to them instead changes
+	// them in the enclosing scope.
+	vars, sv := []string{}, ""
 	if l.IndexVar != "" {
-		sv = fmt.Sprintf("var %s=i,%s=it[i];", l.IndexVar, l.ValueVar)
-	} else if l.ValueVar != "" {
-		sv = fmt.Sprintf("var %s=it[i];", l.ValueVar)
+		vars = append(vars, l.IndexVar, index)
+	}
+	if l.ValueVar != "" {
+		vars = append(vars, l.ValueVar, elem)
+	}
+	if l.Assign {
+		for i := 0; i < len(vars); i += 2 {
+			sv += fmt.Sprintf("%s=%s;", vars[i], vars[i+1])
+		}
+		vars = nil
+	}
+
+	subj := l.Subject.expr()
+	if _, ok := deref(l.Subject.typ()).(anything); ok {
+		subj = fmt.Sprintf("$.$entries(%s,%t)", subj, l.Options.RuntimeChecks)
+	}
+
+	body := sv + l.wrap(elem, vars, l.Body) + ";"
+	if jumps(l.Body) {
+		body = fmt.Sprintf("%sif(%s===1)break;", sv, l.wrap(elem, vars, l.Body))
+	}
+
+	// As in Go, a break in the else branch only leaves the else branch, but
+	// a continue applies to the enclosing loop.
+	els := l.wrap("ctx", nil, l.Else)
+	if jumps(l.Else) {
+		els = fmt.Sprintf("if(%s===2)return 2;", els)
+	}
+
+	if isSeq {
+		return fmt.Sprintf(""+
+			"var any=$.$range(%s,%t,function(a,b){%sreturn %s});"+
+			"if(!any){%s}",
+			subj, seq.Key != nil, sv, l.wrap(elem, vars, l.Body), els)
 	}
 
 	return fmt.Sprintf(""+
 		"var any=false;"+
-		"var it=%s;"+
-		"for(var i=0;it&&i<it.length;i++){%s;any=true;}"+
+		"var it=%s;%s"+
+		"for(var i=0;it&&i<%s;i++){any=true;%s}"+
 		"if(!any){%s}",
-		l.Subject.expr(), l.wrap("it[i]", sv, l.Body), l.wrap("ctx", "", l.Else))
+		subj, keys, length, body, els)
 }
 
 func (c Conditional) stmt() string {
@@ -72,12 +393,54 @@ func (c Conditional) stmt() string {
 	if c.SetContext {
 		call = "v"
 	}
-	sv := ""
-	if c.CondVar != "" {
-		sv = fmt.Sprintf("var %s=v;", c.CondVar)
+	vars, assign := []string{}, ""
+	if c.CondVar != "" && c.Assign {
+		assign = fmt.Sprintf("%s=v;", c.CondVar)
+	} else if c.CondVar != "" {
+		vars = append(vars, c.CondVar, "v")
 	}
-	return fmt.Sprintf("var v=%s;if(v){%s}else{%s}",
-		c.Conditional.expr(), c.wrap(call, sv, c.Body), c.wrap("ctx", "", c.Else))
+	return fmt.Sprintf("var v=%s;%sif(%s){%s}else{%s}",
+		c.Conditional.expr(), assign, truth(c.Conditional.typ()),
+		propagate(c.wrap(call, vars, c.Body), c.Body), propagate(c.wrap("ctx", nil, c.Else), c.Else))
+}
+
+func (c Comment) stmt() string {
+	if c.Text == "" {
+		return ""
+	}
+	return "/* " + strings.Replace(c.Text, "*/", "* /", -1) + " */"
+}
+
+func (Break) stmt() string    { return "return 1;" }
+func (Continue) stmt() string { return "return 2;" }
+
+// jumps returns true if s may break or continue an enclosing loop.
+func jumps(s []Statement) bool {
+	for _, stmt := range s {
+		switch stmt := stmt.(type) {
+		case *Break, *Continue:
+			return true
+		case *Conditional:
+			if jumps(stmt.Body) || jumps(stmt.Else) {
+				return true
+			}
+		case *Loop:
+			// Only the else branch is outside of the inner loop.
+			if jumps(stmt.Else) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// propagate returns code to run call, which wraps s, passing on any break or
+// continue to the enclosing loop.
+func propagate(call string, s []Statement) string {
+	if jumps(s) {
+		return fmt.Sprintf("var r=%s;if(r)return r;", call)
+	}
+	return call
 }
 
 func (i Include) stmt() string {
@@ -87,14 +450,29 @@ func (i Include) stmt() string {
 	return fmt.Sprintf("out+=_tmpls[%s]();", quote(i.Name))
 }
 
-func (s Scope) wrap(callee string, before string, inner []Statement) string {
-	return fmt.Sprintf("(function(ctx){%s%s})(%s)", before, catStmts(inner), callee)
+// wrap returns code to run inner in a closure, with ctx set to callee, and
+// each of vars (pairs of names and values) declared. As with ctx, the values
+// are passed as arguments: evaluated inside the closure, locals of the
+// generated code (such as v and it) would refer to those of inner, since
+// JavaScript hoists their declarations to the top of the function.
+func (s Scope) wrap(callee string, vars []string, inner []Statement) string {
+	params, args := []string{"ctx"}, []string{callee}
+	for i := 0; i < len(vars); i += 2 {
+		params = append(params, vars[i])
+		args = append(args, vars[i+1])
+	}
+	return fmt.Sprintf("(function(%s){%s})(%s)",
+		strings.Join(params, ","), s.catStmts(inner), strings.Join(args, ","))
 }
 
-func catStmts(s []Statement) string {
+func (s Scope) catStmts(stmts []Statement) string {
 	res := ""
-	for _, arg := range s {
-		res += arg.stmt()
+	for _, arg := range stmts {
+		if code := arg.stmt(); code != "" && s.Options.Debug {
+			res += "\n" + code
+		} else {
+			res += code
+		}
 	}
 	return res
 }
@@ -2,11 +2,15 @@ package ast
 
 import (
 	"fmt"
+	"reflect"
+	"strings"
 )
 
 func (l Literal) typ() Type {
-	if l.FloatVal != nil {
-		return number{}
+	if l.IntVal != nil {
+		return number{Kind: reflect.Int, Big: l.Big}
+	} else if l.FloatVal != nil {
+		return number{Kind: reflect.Float64}
 	} else if l.BoolVal != nil {
 		return boolean{}
 	} else if l.StringVal != nil {
@@ -28,10 +32,19 @@ func (f Field) typ() Type {
 	return typ
 }
 
+func (d Dynamic) typ() Type { return anything{} }
+func (c Compare) typ() Type { return boolean{} }
+func (c Call) typ() Type {
+	if fn, ok := deref(c.Func.typ()).(function); ok {
+		return fn.Return
+	}
+	return anything{}
+}
+
 func (f Local) typ() Type    { return f.T }
 func (f SetLocal) typ() Type { return f.Value.typ() }
 func (f Context) typ() Type  { return f.T }
-func (f Global) typ() Type   { return f.S }
+func (f Global) typ() Type   { return globals(f.S.Funcs) }
 
 func (f function) String() string {
 	args := ""
@@ -55,11 +68,100 @@ func (f function) Iterate() Type {
 	panic("Functions are not iterable")
 }
 
+func (c comparison) String() string { return "function (*, *): boolean" }
+func (c comparison) FieldNamed(s string) (string, Type) {
+	panic(fmt.Sprintf("Function has no field %#v", s))
+}
+func (c comparison) Iterate() Type {
+	panic("Functions are not iterable")
+}
+
+func (c caller) String() string { return "function (function, ...*): *" }
+func (c caller) FieldNamed(s string) (string, Type) {
+	panic(fmt.Sprintf("Function has no field %#v", s))
+}
+func (c caller) Iterate() Type {
+	panic("Functions are not iterable")
+}
+
+// check panics unless the function value args[0] can be called with the
+// rest of args, so far as their types are known statically.
+func (c caller) check(args []Expression) {
+	if len(args) == 0 {
+		panic("wrong number of args for call: want at least 1 got 0")
+	}
+	switch fn := deref(args[0].typ()).(type) {
+	case anything:
+		// Checked at runtime.
+	case function:
+		if fn.Return == nil {
+			panic(fmt.Sprintf("can't call function %s with no results", fn))
+		}
+		fn.checkArgs("call", args[1:])
+	default:
+		panic(fmt.Sprintf("non-function of type %s", args[0].typ()))
+	}
+}
+
+// check panics unless the given arguments can be compared with c, as
+// text/template would, so far as their types are known statically.
+func (c comparison) check(args []Expression) {
+	if c.Op == "eq" && len(args) < 2 {
+		panic("missing argument for comparison")
+	} else if c.Op != "eq" && len(args) != 2 {
+		panic(fmt.Sprintf("wrong number of args for %s: want 2 got %d", c.Op, len(args)))
+	}
+
+	first := args[0].typ()
+	for _, arg := range args {
+		k1, k2 := basicKind(first), basicKind(arg.typ())
+		switch {
+		case k1 == "*" || k2 == "*":
+			// Checked at runtime.
+		case k2 == "" || c.Op != "eq" && c.Op != "ne" && k2 == "bool":
+			panic(fmt.Sprintf("invalid type for comparison: %s", arg.typ()))
+		case k1 != k2 && !(k1 == "int" && k2 == "uint" || k1 == "uint" && k2 == "int"):
+			panic(fmt.Sprintf("incompatible types for comparison: %s and %s",
+				first, arg.typ()))
+		}
+	}
+}
+
+// basicKind returns the kind of values of type t, as text/template compares
+// them: "bool", "int", "uint", "float" or "string", or "*" if this is only
+// known at runtime. Other types can't be compared in JavaScript, so are "".
+func basicKind(t Type) string {
+	switch t := t.(type) {
+	case anything:
+		return "*"
+	case boolean:
+		return "bool"
+	case str:
+		return "string"
+	case number:
+		switch t.Kind {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return "int"
+		case reflect.Float32, reflect.Float64:
+			return "float"
+		}
+		return "uint"
+	}
+	return ""
+}
+
 func (o object) String() string {
+	if o.Name != "" {
+		return o.Name
+	}
+
 	props := ""
 	first := true
-	for s := range o.Fields {
-		label, typ := o.FieldNamed(s)
+	for s, typ := range o.Fields {
+		label := s
+		if field, ok := o.JSON[s]; ok && !field.Inline {
+			label = field.Label
+		}
 
 		if first {
 			first = false
@@ -76,16 +178,31 @@ func (o object) FieldNamed(s string) (string, Type) {
 	if !ok {
 		panic(fmt.Sprintf("Object %s has no field %#v", o, s))
 	}
-	label, ok := o.Labels[s]
+	if clientSide(typ) {
+		return s, typ
+	}
+	field, ok := o.JSON[s]
 	if !ok {
-		label = s
+		panic(fmt.Sprintf("field %s of %s is not encoded by encoding/json", s, o))
 	}
-	return label, typ
+	return field.Label, typ
 }
 func (o object) Iterate() Type {
 	panic("Objects are not iterable")
 }
 
+func (n nothing) String() string { return "no data" }
+func (n nothing) FieldNamed(s string) (string, Type) {
+	panic(fmt.Sprintf("nil data; no entry for key %q", s))
+}
+func (n nothing) Iterate() Type {
+	panic("range can't iterate over <nil>")
+}
+
+func (a anything) String() string                     { return "*" }
+func (a anything) FieldNamed(s string) (string, Type) { return s, anything{} }
+func (a anything) Iterate() Type                      { return anything{} }
+
 func (a array) String() string { return fmt.Sprintf("Array.<%s>", a.Contains) }
 func (a array) FieldNamed(s string) (string, Type) {
 	panic(fmt.Sprintf("Array %s has no field %#v", a, s))
@@ -94,6 +211,84 @@ func (a array) Iterate() Type {
 	return a.Contains
 }
 
+func (p pointer) String() string                     { return "*" + p.Elem.String() }
+func (p pointer) FieldNamed(s string) (string, Type) { return p.Elem.FieldNamed(s) }
+func (p pointer) Iterate() Type                      { return p.Elem.Iterate() }
+
+func (m mapping) String() string {
+	return fmt.Sprintf("Object.<%s, %s>", m.Key, m.Elem)
+}
+func (m mapping) FieldNamed(s string) (string, Type) {
+	if _, ok := m.Key.(str); !ok {
+		panic(fmt.Sprintf("Map %s has no field %#v (its keys are not strings)", m, s))
+	}
+	return s, m.Elem
+}
+func (m mapping) Iterate() Type {
+	return m.Elem
+}
+
+// deref returns the type pointed to by t, if it is a pointer.
+func deref(t Type) Type {
+	for {
+		p, ok := t.(pointer)
+		if !ok {
+			return t
+		}
+		t = p.Elem
+	}
+}
+
+// clientSide returns true if values of type t can't be sent as JSON, and so
+// are provided by the client itself.
+func clientSide(t Type) bool {
+	switch t.(type) {
+	case function, iterator:
+		return true
+	}
+	return false
+}
+
+// rangeTypes returns the types of the index and element when ranging over t
+// with the given number of variables, as text/template does.
+func rangeTypes(t Type, vars int) (index, elem Type) {
+	switch t := deref(t).(type) {
+	case mapping:
+		return t.Key, t.Elem
+	case number:
+		if !t.integer() {
+			panic(fmt.Sprintf("range can't iterate over %s", t))
+		} else if vars > 1 {
+			panic(fmt.Sprintf("can't use %s to iterate over more than one variable", t))
+		}
+		return nil, t
+	case iterator:
+		if t.Key == nil && vars > 1 {
+			panic(fmt.Sprintf("can't use %s to iterate over more than one variable", t))
+		} else if t.Key == nil {
+			return nil, t.Elem
+		} else if vars < 2 {
+			// With one variable, the element is the key.
+			return nil, t.Key
+		}
+		return t.Key, t.Elem
+	}
+	return number{Kind: reflect.Int}, t.Iterate()
+}
+
+func (i iterator) String() string {
+	if i.Key == nil {
+		return fmt.Sprintf("Iterator.<%s>", i.Elem)
+	}
+	return fmt.Sprintf("Iterator.<%s, %s>", i.Key, i.Elem)
+}
+func (i iterator) FieldNamed(s string) (string, Type) {
+	panic(fmt.Sprintf("Iterator %s has no field %#v", i, s))
+}
+func (i iterator) Iterate() Type {
+	return i.Elem
+}
+
 func (b boolean) String() string { return "boolean" }
 func (b boolean) FieldNamed(s string) (string, Type) {
 	panic(fmt.Sprintf("Boolean has no field %#v", s))
@@ -110,12 +305,20 @@ func (s str) Iterate() Type {
 	panic("Strings are not iterable")
 }
 
-func (n number) String() string { return "number" }
+func (n number) String() string { return n.Kind.String() }
 func (n number) FieldNamed(s string) (string, Type) {
 	panic(fmt.Sprintf("Numbers have no field %#v", s))
 }
 func (n number) Iterate() Type {
-	panic("Numbers are not iterable")
+	if !n.integer() {
+		panic("Floats are not iterable")
+	}
+	return n
+}
+
+// integer returns true if the number is a Go integer (rather than a float).
+func (n number) integer() bool {
+	return n.Kind != reflect.Float32 && n.Kind != reflect.Float64
 }
 
 // Pretty-prints the current global scope.
@@ -126,36 +329,181 @@ func (s *Scope) child() *Scope {
 		Context:   s.Context,
 		Variables: map[string]Type{},
 		Parent:    s,
+		Options:   s.Options,
+		Funcs:     s.Funcs,
+		labels:    map[string]string{},
+		declared:  s.declared,
+		set:       s.set,
+	}
+}
+
+func (s *Scope) warn(msg string) {
+	if s.Options.Warn != nil {
+		s.Options.Warn(msg)
 	}
 }
 
-// FieldNamed returns the given field of the current scope.
+// FieldNamed returns the JavaScript name and type of the given variable of the
+// current scope.
 func (s *Scope) FieldNamed(name string) (string, Type) {
 	typ, ok := s.Variables[name]
 	if !ok {
 		if s.Parent != nil {
 			return s.Parent.FieldNamed(name)
 		}
-		panic(fmt.Sprintf("no global variable %s (candidates %#v)", name,
-			s.Variables))
+		panic(fmt.Sprintf("undefined variable %s", name))
+	}
+	if label, ok := s.labels[name]; ok {
+		return label, typ
 	}
 	return name, typ
 }
 
+// declare adds a variable to the current scope, returning its JavaScript
+// name. Every declaration of a name gets its own variable ($x, then $x$2,
+// and so on), since JavaScript hoists declarations to the top of the
+// enclosing function, where they would hide earlier variables of the same
+// name. Since template variables can't contain "$" after the first letter,
+// these never collide with one another, nor with the generated code (whose
+// locals don't start with "$").
+func (s *Scope) declare(name string, t Type) string {
+	s.Variables[name] = t
+	s.declared[name]++
+	label := name
+	if n := s.declared[name]; n > 1 {
+		label = fmt.Sprintf("%s$%d", name, n)
+	}
+	s.labels[name] = label
+	return label
+}
+
+func (g globals) String() string { return "$" }
+func (g globals) FieldNamed(name string) (string, Type) {
+	typ, ok := g[name]
+	if !ok {
+		panic(fmt.Sprintf("function %q not defined", strings.TrimPrefix(name, "$")))
+	}
+	return name, typ
+}
+func (g globals) Iterate() Type {
+	panic("cannot Iterate over global object")
+}
+
 // Iterate throws, since the user cannot iterate over $.
 func (s *Scope) Iterate() Type {
 	panic(fmt.Errorf("cannot Iterate over global object"))
 }
 
-func fieldOrMethod(subject Expression, name string, args []Expression) Expression {
+// assignable returns true if a value of type from may be passed where a
+// value of type to is expected.
+func assignable(to, from Type) bool {
+	// As in text/template, pointers are dereferenced as needed.
+	to, from = deref(to), deref(from)
+	switch to := to.(type) {
+	case anything:
+		return true
+	case array:
+		if from, ok := from.(array); ok {
+			return assignable(to.Contains, from.Contains)
+		}
+	case number:
+		if from, ok := from.(number); ok && to.integer() && !from.integer() {
+			return false
+		}
+	}
+	if _, ok := from.(anything); ok {
+		return true
+	}
+	return reflect.TypeOf(to) == reflect.TypeOf(from)
+}
+
+// checkArgs panics unless the given arguments can be passed to f.
+func (f function) checkArgs(name string, args []Expression) {
+	n := len(f.Args)
+	if f.Variadic {
+		if len(args) < n-1 {
+			panic(fmt.Sprintf("wrong number of args for %s: want at least %d got %d",
+				name, n-1, len(args)))
+		}
+	} else if len(args) != n {
+		panic(fmt.Sprintf("wrong number of args for %s: want %d got %d",
+			name, n, len(args)))
+	}
+
+	for i, arg := range args {
+		param := f.Args[len(f.Args)-1]
+		if i < len(f.Args) {
+			param = f.Args[i]
+		}
+		if !assignable(param, arg.typ()) {
+			panic(fmt.Sprintf("wrong type for value; expected %s; got %s",
+				param, arg.typ()))
+		}
+	}
+}
+
+// lossy returns true if values of type t are (or hold, as elements, keys or
+// results) 64-bit integers, which lose precision in JavaScript.
+func lossy(t Type) bool {
+	switch t := t.(type) {
+	case number:
+		return (t.Kind == reflect.Int64 || t.Kind == reflect.Uint64) && !t.Big
+	case pointer:
+		return lossy(t.Elem)
+	case array:
+		return lossy(t.Contains)
+	case mapping:
+		return lossy(t.Key) || lossy(t.Elem)
+	case iterator:
+		return t.Key != nil && lossy(t.Key) || lossy(t.Elem)
+	case function:
+		return t.Return != nil && lossy(t.Return)
+	}
+	return false
+}
+
+func fieldOrMethod(sc *Scope, subject Expression, name string, args []Expression) Expression {
+	if _, ok := deref(subject.typ()).(anything); ok {
+		return &Dynamic{
+			Subject: subject,
+			Name:    name,
+			Args:    args,
+			Checked: sc.Options.RuntimeChecks,
+		}
+	}
+
 	_, typ := subject.typ().FieldNamed(name)
-	switch typ.(type) {
+	if _, global := subject.(*Global); lossy(typ) && !global {
+		which := "which loses"
+		if _, ok := typ.(number); !ok {
+			which = "whose 64-bit integers lose"
+		}
+		sc.warn(fmt.Sprintf("field %s of %s is a %s, %s precision beyond 2^53 "+
+			"in JavaScript (see BigIntegers)", name, subject.typ(), typ, which))
+	}
+	switch typ := typ.(type) {
+	case comparison:
+		typ.check(args)
+		return &Compare{Op: typ.Op, Args: args}
+	case caller:
+		typ.check(args)
+		return &Call{Func: args[0], Args: args[1:]}
 	case function:
-		return &Method{Subject: subject, Name: name, Args: args}
-	default:
-		if len(args) > 0 {
-			panic(fmt.Sprintf("%#v is not callable", typ))
+		// Function values (other than global helpers) are only invoked with
+		// call, as in Go.
+		if _, global := subject.(*Global); typ.Method || global {
+			typ.checkArgs(strings.TrimPrefix(name, "$"), args)
+			return &Method{Subject: subject, Name: name, Args: args}
+		} else if len(args) > 0 {
+			panic(fmt.Sprintf("%s has arguments but cannot be invoked as function", name))
 		}
-		return &Field{Subject: subject, Name: name}
 	}
+
+	if len(args) > 0 {
+		panic(fmt.Sprintf("%s is not callable", typ))
+	}
+	if _, ok := deref(subject.typ()).(mapping); ok {
+		return &Field{Subject: subject, Name: name, MissingKey: sc.Options.MissingKey}
+	}
+	return &Field{Subject: subject, Name: name}
 }
@@ -1,8 +1,13 @@
 package tmpl2js
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"github.com/fatlotus/tmpl2js/ast"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 
 	html_template "html/template"
@@ -19,20 +24,61 @@ var header = minify(`
 	var out = "";
 	var $ = ctx || {};
 	var MAP = {
+		'\u0000': '\uFFFD',
 		'&': '&amp;',
 		'<': '&lt;',
 		'>': '&gt;',
-		'"': '&quot;',
-		"'": '&#39;'
-	};
-	$.$le = function(a, b) { return a <= b };
-	$.$lt = function(a, b) { return a < b };
-	$.$gt = function(a, b) { return a > b };
-	$.$ge = function(a, b) { return a >= b };
-	$.$eq = function(a, b) { return a == b };
-	$.$ne = function(a, b) { return a != b };
-	$.$_html_template_htmlescaper = $_html_template_attrescaper = function(s) {
-		return (""+s).replace(/[&<>'"]/g, function(c) {return MAP[c];});
+		'"': '&#34;',
+		"'": '&#39;',
+		'+': '&#43;'
+	};
+	$.$kind = function(v) {
+		var t = typeof v;
+		if (t === "bigint" || typeof BigInt === "function" && v instanceof BigInt) {
+			return "number";
+		}
+		return t === "number" || t === "string" || t === "boolean" ? t : "";
+	};
+	$.$comparable = function(a, b, ordered) {
+		var ka = $.$kind(a), kb = $.$kind(b);
+		if (!ka || !kb || ordered && ka === "boolean") {
+			throw new Error("invalid type for comparison");
+		} else if (ka !== kb) {
+			throw new Error("incompatible types for comparison: " + ka + " and " + kb);
+		}
+	};
+	$.$eq = function(a) {
+		if (arguments.length < 2) {
+			throw new Error("missing argument for comparison");
+		}
+		for (var i = 1; i < arguments.length; i++) {
+			var b = arguments[i];
+			if (a === null || a === undefined || b === null || b === undefined) {
+				if (a === b) {
+					return true;
+				}
+				continue;
+			}
+			$.$comparable(a, b, false);
+			if (a == b) {
+				return true;
+			}
+		}
+		return false;
+	};
+	$.$lt = function(a, b) {
+		$.$comparable(a, b, true);
+		return typeof a === "string" ? $.$cmp(a, b) < 0 : a < b;
+	};
+	$.$le = function(a, b) {
+		$.$comparable(a, b, true);
+		return typeof a === "string" ? $.$cmp(a, b) <= 0 : a <= b;
+	};
+	$.$bigint = function(x) {
+		return typeof BigInt === "function" ? BigInt(x) : Number(x);
+	};
+	$.$_html_template_htmlescaper = $.$_html_template_attrescaper = function(s) {
+		return (""+s).replace(/[\u0000&<>'"+]/g, function(c) {return MAP[c];});
 	};
 	$.$_html_template_urlescaper = function(s) {
 		return encodeURIComponent("" + s);
@@ -43,59 +89,630 @@ var header = minify(`
 			"script tag {{ }}, which is unsupported."
 		);
 	};
+	$.$sprint = function(args, kinds) {
+		var res = "", str = true;
+		for (var i = 0; i < args.length; i++) {
+			var k = kinds.charAt(i);
+			var isStr = k === "s" || k === "*" && typeof args[i] === "string";
+			if (i > 0 && !isStr && !str) {
+				res += " ";
+			}
+			res += args[i];
+			str = isStr;
+		}
+		return res;
+	};
+	$.$html = function(s) {
+		return s.replace(/[\u0000&<>'"]/g, function(c) {return MAP[c];});
+	};
+	$.$urlquery = function(s) {
+		return encodeURIComponent(s).replace(/[!'()*]/g, function(c) {
+			return "%" + c.charCodeAt(0).toString(16).toUpperCase();
+		}).replace(/%20/g, "+");
+	};
 	$.$json = function(s) {
 		return JSON.stringify("" + s);
 	};
+	$.$invoke = function(name, obj, method, args) {
+		var res;
+		try {
+			res = obj[method].apply(obj, args);
+		} catch (e) {
+			throw new Error("error calling " + name + ": " + (e && e.message || e));
+		}
+		if (res instanceof Error) {
+			throw new Error("error calling " + name + ": " + res.message);
+		}
+		return res;
+	};
+	$.$call = function(fn, args) {
+		var res;
+		if (fn === null || fn === undefined) {
+			throw new Error("error calling call: call of nil");
+		} else if (typeof fn !== "function") {
+			throw new Error("error calling call: non-function of type " + typeof fn);
+		}
+		try {
+			res = fn.apply(undefined, args);
+		} catch (e) {
+			throw new Error("error calling call: " + (e && e.message || e));
+		}
+		if (res instanceof Error) {
+			throw new Error("error calling call: " + res.message);
+		}
+		return res;
+	};
+	$.$float = function(x) {
+		if (typeof x !== "number") {
+			return x;
+		} else if (x !== x) {
+			return "NaN";
+		} else if (x === Infinity || x === -Infinity) {
+			return x > 0 ? "+Inf" : "-Inf";
+		} else if (x === 0) {
+			return 1 / x < 0 ? "-0" : "0";
+		}
+		var m = /^(-?\d(?:\.\d+)?)e([+-])(\d+)$/.exec(x.toExponential());
+		var exp = (m[2] === "-" ? -1 : 1) * parseInt(m[3], 10);
+		if (exp < -4 || exp >= 6) {
+			return m[1] + "e" + m[2] + (m[3].length < 2 ? "0" : "") + m[3];
+		}
+		return "" + x;
+	};
+	$.$big = function(s) {
+		return typeof s === "string" && typeof BigInt === "function" ? BigInt(s) : s;
+	};
+	$.$unquote = function(v) {
+		return v === null || v === undefined ? v : JSON.parse(v);
+	};
+	$.$default = function(v, zero) {
+		return v === undefined ? zero : v;
+	};
+	$.$dynamic = function(obj, name, args, check) {
+		if (obj === null || obj === undefined) {
+			throw new Error("nil pointer evaluating interface {}." + name);
+		}
+		var v = obj[name];
+		if (typeof v === "function") {
+			return v.apply(obj, args);
+		}
+		if (check && v === undefined) {
+			throw new Error("can't evaluate field " + name + " in dynamic value");
+		}
+		if (check && args.length > 0) {
+			throw new Error(name + " has arguments but cannot be invoked as function");
+		}
+		return v;
+	};
+	$.$deref = function(v, what) {
+		if (v === null || v === undefined) {
+			throw new Error("nil pointer evaluating " + what);
+		}
+		return v;
+	};
+	$.$key = function(m, k, missing, zero) {
+		if (m !== null && m !== undefined && Object.prototype.hasOwnProperty.call(m, k)) {
+			return m[k];
+		} else if (missing === "error") {
+			throw new Error("map has no entry for key " + JSON.stringify(k));
+		}
+		return missing === "zero" ? zero : undefined;
+	};
+	$.$cmp = function(a, b) {
+		for (var i = 0; i < a.length && i < b.length; i++) {
+			var c = a.charCodeAt(i), d = b.charCodeAt(i);
+			if (c !== d) {
+				c += c >= 0xE000 ? -0x800 : c >= 0xD800 ? 0x2000 : 0;
+				d += d >= 0xE000 ? -0x800 : d >= 0xD800 ? 0x2000 : 0;
+				return c < d ? -1 : 1;
+			}
+		}
+		return a.length - b.length;
+	};
+	$.$keys = function(m, numeric) {
+		var ks = m === null || m === undefined ? [] : Object.keys(m);
+		return ks.sort(numeric ? function(a, b) { return a - b; } : $.$cmp);
+	};
+	$.$print = function(v, nil, missing) {
+		if (v === undefined) {
+			return missing === undefined ? "<no value>" : missing;
+		} else if (v === null) {
+			return nil;
+		} else if (v instanceof Array) {
+			var items = [];
+			for (var i = 0; i < v.length; i++) {
+				items.push($.$print(v[i], "<nil>"));
+			}
+			return "[" + items.join(" ") + "]";
+		}
+		return v;
+	};
+	$.$truth = function(v, map) {
+		if (v instanceof Array) {
+			return v.length > 0;
+		} else if (map && v) {
+			return Object.keys(v).length > 0;
+		}
+		return !!v;
+	};
+	$.$range = function(seq, pairs, body) {
+		var any = false, i, r;
+		var call = function(v) {
+			any = true;
+			return pairs ? body(v[0], v[1]) : body(v);
+		};
+		if (typeof seq === "function") {
+			r = seq(function(a, b) {
+				any = true;
+				return body(a, b) !== 1;
+			});
+			if (!r || typeof r.next !== "function") {
+				return any;
+			}
+			seq = r;
+		}
+		if (seq instanceof Array) {
+			for (i = 0; i < seq.length && call(seq[i]) !== 1; i++) {}
+		} else if (seq && typeof seq.next === "function") {
+			for (r = seq.next(); !r.done && call(r.value) !== 1; r = seq.next()) {}
+		}
+		return any;
+	};
+	$.$entries = function(v, check) {
+		var ks = [], vs = [], i;
+		if (v instanceof Array) {
+			for (i = 0; i < v.length; i++) {
+				ks.push(i);
+				vs.push(v[i]);
+			}
+		} else if (typeof v === "number" && v % 1 === 0) {
+			for (i = 0; i < v; i++) {
+				ks.push(i);
+				vs.push(i);
+			}
+		} else if (v !== null && typeof v === "object") {
+			ks = $.$keys(v, false);
+			for (i = 0; i < ks.length; i++) {
+				vs.push(v[ks[i]]);
+			}
+		} else if (check && v !== null && v !== undefined) {
+			throw new Error("range can't iterate over " + v);
+		}
+		return {k: ks, v: vs};
+	};
+`)
+
+// jsEscaper ports text/template's JSEscapeString. Since it needs a table of
+// the printable runes, it is only included in templates that use it.
+var jsEscaper = minify(`
+	var JS = {
+		'\\': '\\\\',
+		"'": "\\'",
+		'"': '\\"',
+		'<': '\\u003C',
+		'>': '\\u003E',
+		'&': '\\u0026',
+		'=': '\\u003D'
+	};
+	var NONPRINTABLE = (function(table) {
+		var bounds = [], r = 0x80;
+		for (var i = 0; i < table.length; i += 2) {
+			r += parseInt(table[i], 36);
+			bounds.push(r);
+			r += parseInt(table[i + 1], 36);
+			bounds.push(r);
+		}
+		return bounds;
+	})("` + nonPrintable + `".split(","));
+	$.$printable = function(r) {
+		var lo = 0, hi = NONPRINTABLE.length;
+		while (lo < hi) {
+			var mid = (lo + hi) >> 1;
+			if (NONPRINTABLE[mid] <= r) {
+				lo = mid + 1;
+			} else {
+				hi = mid;
+			}
+		}
+		return lo % 2 === 0;
+	};
+	$.$js = function(s) {
+		var res = "";
+		for (var i = 0; i < s.length; i++) {
+			var c = s.charCodeAt(i), ch = s.charAt(i);
+			if (c >= 0xD800 && c < 0xDC00 && i + 1 < s.length) {
+				var d = s.charCodeAt(i + 1);
+				if (d >= 0xDC00 && d < 0xE000) {
+					ch = String.fromCharCode(c, d);
+					c = (c - 0xD800) * 0x400 + (d - 0xDC00) + 0x10000;
+					i++;
+				}
+			}
+			if (JS.hasOwnProperty(ch)) {
+				res += JS[ch];
+			} else if (c >= 0x20 && c < 0x80 || c >= 0x80 && $.$printable(c)) {
+				res += ch;
+			} else {
+				var hex = c.toString(16).toUpperCase();
+				while (hex.length < 4) {
+					hex = "0" + hex;
+				}
+				res += "\\u" + hex;
+			}
+		}
+		return res;
+	};
 `)
 
 var footer = minify(`
 	return out
 })`)
 
+// An Option customizes the JavaScript produced by a conversion.
+type Option func(*ast.Options)
+
+// WithBigIntegers sends 64-bit integers as decimal strings, which the
+// generated JavaScript reads as BigInts (where supported), so that values
+// beyond 2^53 aren't rounded. The data must then be encoded with EncodeJSON.
+func WithBigIntegers() Option {
+	return func(o *ast.Options) { o.BigIntegers = true }
+}
+
+// WithWarnings calls warn to describe parts of the template that may not
+// behave the same way in JavaScript as in Go (such as 64-bit integers
+// without WithBigIntegers).
+func WithWarnings(warn func(msg string)) Option {
+	return func(o *ast.Options) { o.Warn = warn }
+}
+
+// WithMissingKey sets what the generated code does when a map has no entry
+// for a key, as Template.Option("missingkey=...") does in text/template:
+//
+//	"default" or "invalid"
+//		A map with no entry for a key prints "<no value>".
+//	"zero"
+//		The zero value of the map's element type is used instead.
+//	"error"
+//		Rendering stops with an error.
+//
+// By default, the option is read from the template itself; if given, it must
+// agree with the template's. As in text/template, unknown actions panic.
+func WithMissingKey(action string) Option {
+	switch action {
+	case "invalid":
+		action = "default"
+	case "default", "zero", "error":
+	default:
+		panic("unrecognized option: missingkey=" + action)
+	}
+	return func(o *ast.Options) { o.MissingKey = action }
+}
+
+// WithTemplateContext gives the type of the data passed to the named template,
+// as an example value. This is only needed for templates that aren't included
+// by another: the type of the others is inferred from their {{template}}
+// actions, and the template executed first is given exampleContext.
+func WithTemplateContext(name string, exampleContext interface{}) Option {
+	return func(o *ast.Options) {
+		if o.Contexts == nil {
+			o.Contexts = map[string]reflect.Type{}
+		}
+		o.Contexts[name] = reflect.TypeOf(exampleContext)
+	}
+}
+
+func newOptions(opts []Option) *ast.Options {
+	options := &ast.Options{}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+// EncodeJSON encodes v as JSON, in the form expected by JavaScript generated
+// with the same options. Without WithBigIntegers, this is json.Marshal.
+func EncodeJSON(v interface{}, opts ...Option) ([]byte, error) {
+	options := newOptions(opts)
+	data, err := json.Marshal(v)
+	if err != nil || !options.BigIntegers {
+		return data, err
+	}
+
+	var generic interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&generic); err != nil {
+		return nil, err
+	}
+	typ := options.NewType(reflect.TypeOf(v))
+	return json.Marshal(ast.EncodeBigIntegers(typ, generic))
+}
+
+// WithDebug makes the generated JavaScript easier to read, by putting each
+// statement on its own line, and keeping the comments of templates parsed
+// with parse.ParseComments.
+func WithDebug() Option {
+	return func(o *ast.Options) { o.Debug = true }
+}
+
+// WithRuntimeChecks makes the generated JavaScript verify, as it runs, that
+// values of dynamic type (such as interface{} fields) have the fields and
+// elements that the template uses, rather than silently rendering undefined.
+func WithRuntimeChecks() Option {
+	return func(o *ast.Options) { o.RuntimeChecks = true }
+}
+
+// WithType declares that values of the same type as example are encoded in
+// JSON the same way as values of the same type as repr. This is needed for
+// types implementing json.Marshaler, whose JSON representation can't be
+// inferred:
+//
+//	tmpl2js.WithType(Money{}, "")  // Money marshals itself as a string
+//
+// Types from the standard library, such as time.Time, are known already.
+func WithType(example, repr interface{}) Option {
+	return func(o *ast.Options) {
+		if o.Types == nil {
+			o.Types = map[reflect.Type]reflect.Type{}
+		}
+		o.Types[reflect.TypeOf(example)] = reflect.TypeOf(repr)
+	}
+}
+
 // ConvertTree converts the given template parse tree into a JavaScript
 // function.
 //
 // It accepts a single argument, which is the context used for the template.
-func ConvertTree(tree *parse.Tree, exampleContext interface{}, funcMap map[string]interface{}) (string, error) {
-	rootType := ast.NewType(reflect.TypeOf(exampleContext))
-	scope := ast.NewScope(rootType)
+func ConvertTree(tree *parse.Tree, exampleContext interface{}, funcMap map[string]interface{}, opts ...Option) (string, error) {
+	options := newOptions(opts)
+	scope := ast.NewScope(options.NewType(reflect.TypeOf(exampleContext)))
+	scope.Options = options
 	for key, value := range funcMap {
-		scope.Variables["$"+key] = ast.NewType(reflect.TypeOf(value))
+		scope.Funcs["$"+key] = options.NewType(reflect.TypeOf(value))
 	}
 	code, err := ast.Process(tree, scope)
-	return header + code + footer, err
+	return function(code), err
+}
+
+// function wraps the code for a template into a JavaScript function, along
+// with the helpers it needs.
+func function(code string) string {
+	if strings.Contains(code, "$.$js(") {
+		code = jsEscaper + code
+	}
+	return header + code + footer
 }
 
 // ConvertText compiles a parsed *template.Template into a JavaScript function.
 //
 // It accepts a single argument ctx, which is the context used for the template.
-func ConvertText(tmpl *text_template.Template, exampleContext interface{}, funcMap text_template.FuncMap) (string, error) {
-	js := "(_tmpls={},"
-	name := ""
-	for _, tmpl := range tmpl.Templates() {
-		newJs, err := ConvertTree(tmpl.Tree, exampleContext, funcMap)
-		if err != nil {
-			return "", err
-		}
-		js += "_tmpls[\"" + tmpl.Tree.Name + "\"]=" + newJs + ","
-		name = tmpl.Tree.Name
+// As with Execute, this is the template named tmpl.Name(). To render others in
+// the set (as with ExecuteTemplate), the function also has these methods:
+//
+//	render(name, ctx)  renders the named template, or throws if there is none
+//	has(name)          returns true if the set has a template of that name
+//	names()            returns the names of the templates in the set, sorted
+func ConvertText(tmpl *text_template.Template, exampleContext interface{}, funcMap text_template.FuncMap, opts ...Option) (string, error) {
+	js, err := bundle(map[string]layout{tmpl.Name(): textLayout(tmpl)}, exampleContext, funcMap, opts)
+	if err != nil {
+		return "", err
 	}
-	return js + "_tmpls[\"" + name + "\"])", nil
+	return js + "[" + strconv.Quote(tmpl.Name()) + "]", nil
 }
 
 // ConvertHTML compiles a parsed *template.Template into a JavaScript function.
 //
 // It accepts a single argument ctx, which is the context used for the template.
-func ConvertHTML(tmpl *html_template.Template, exampleContext interface{}, funcMap html_template.FuncMap) (string, error) {
-	js := "(_tmpls={},"
-	name := ""
-	for _, tmpl := range tmpl.Templates() {
-		newJs, err := ConvertTree(tmpl.Tree, exampleContext, funcMap)
+// As with ConvertText, the function renders the template named tmpl.Name(),
+// and has methods to render the others.
+func ConvertHTML(tmpl *html_template.Template, exampleContext interface{}, funcMap html_template.FuncMap, opts ...Option) (string, error) {
+	js, err := bundle(map[string]layout{tmpl.Name(): htmlLayout(tmpl)}, exampleContext, funcMap, opts)
+	if err != nil {
+		return "", err
+	}
+	return js + "[" + strconv.Quote(tmpl.Name()) + "]", nil
+}
+
+// A layout is one page of a bundle: a set of templates that may include one
+// another, along with the name of the one to execute.
+type layout struct {
+	root  string
+	trees map[string]*parse.Tree
+
+	// The underlying *text/template.Template, whose missingkey option the
+	// generated code follows (see missingKey).
+	text reflect.Value
+}
+
+func textLayout(tmpl *text_template.Template) layout {
+	trees := map[string]*parse.Tree{}
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil {
+			trees[t.Name()] = t.Tree
+		}
+	}
+	return layout{root: tmpl.Name(), trees: trees, text: reflect.ValueOf(tmpl)}
+}
+
+func htmlLayout(tmpl *html_template.Template) layout {
+	trees := map[string]*parse.Tree{}
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil {
+			trees[t.Name()] = t.Tree
+		}
+	}
+	text := reflect.ValueOf(tmpl).Elem().FieldByName("text")
+	return layout{root: tmpl.Name(), trees: trees, text: text}
+}
+
+// missingKey returns the missingkey option of tmpl, a *text/template.Template
+// (as set with its Option method), so that the generated code agrees with
+// Execute. Since text/template doesn't export it, this is read with reflect;
+// if that fails, the option must be given with WithMissingKey.
+func missingKey(tmpl reflect.Value) (string, error) {
+	if tmpl.Kind() == reflect.Ptr && !tmpl.IsNil() && tmpl.Elem().Kind() == reflect.Struct {
+		common := tmpl.Elem().FieldByName("common")
+		if common.Kind() == reflect.Ptr && common.IsNil() {
+			return "default", nil // nothing has been parsed or set yet
+		}
+		if common.Kind() == reflect.Ptr && common.Elem().Kind() == reflect.Struct {
+			option := common.Elem().FieldByName("option")
+			if option.Kind() == reflect.Struct {
+				// As declared in text/template: mapInvalid, mapZeroValue,
+				// mapError.
+				switch action := option.FieldByName("missingKey"); {
+				case action.Kind() != reflect.Int:
+				case action.Int() == 0:
+					return "default", nil
+				case action.Int() == 1:
+					return "zero", nil
+				case action.Int() == 2:
+					return "error", nil
+				}
+			}
+		}
+	}
+	return "", fmt.Errorf("tmpl2js: can't read the missingkey option of the template; " +
+		"give it with WithMissingKey")
+}
+
+// bundle compiles each layout into one JavaScript object, holding a render
+// function for each page. Every page resolves template names against its own
+// table, so pages can give different definitions to the blocks of a shared
+// layout. Templates shared between pages (as after Clone) are emitted once,
+// and everything is emitted in sorted order, so the output is reproducible.
+//
+// Each template is type-checked against the data passed to it by the
+// {{template}} actions that include it (see ast.Set).
+func bundle(pages map[string]layout, exampleContext interface{}, funcMap map[string]interface{}, opts []Option) (string, error) {
+	names := make([]string, 0, len(pages))
+	for name := range pages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	options := newOptions(opts)
+	exampleType := options.NewType(reflect.TypeOf(exampleContext))
+	funcs := map[string]ast.Type{}
+	for key, value := range funcMap {
+		funcs[key] = options.NewType(reflect.TypeOf(value))
+	}
+
+	// Each tree is emitted as a factory, which binds it to a page's table.
+	index := map[string]int{}
+	trees := []string{}
+	tables := []string{}
+	for _, name := range names {
+		page := pages[name]
+		if page.trees[page.root] == nil {
+			return "", fmt.Errorf("tmpl2js: %q is an incomplete or empty template", page.root)
+		}
+		pageOptions := *options
+		key, err := missingKey(page.text)
+		switch {
+		case options.MissingKey == "" && err != nil:
+			return "", err
+		case options.MissingKey == "":
+			pageOptions.MissingKey = key
+		case err == nil && key != options.MissingKey:
+			return "", fmt.Errorf("tmpl2js: %q has missingkey=%s, but WithMissingKey gives %s",
+				page.root, key, options.MissingKey)
+		}
+		set := &ast.Set{
+			Trees:    page.trees,
+			Contexts: map[string]ast.Type{},
+			Default:  exampleType,
+			Funcs:    funcs,
+			Options:  &pageOptions,
+		}
+		for def, typ := range options.Contexts {
+			set.Contexts[def] = options.NewType(typ)
+		}
+		set.Contexts[page.root] = exampleType
+		code, err := set.Process()
 		if err != nil {
 			return "", err
 		}
-		js += "_tmpls[\"" + tmpl.Tree.Name + "\"]=" + newJs + ","
-		name = tmpl.Tree.Name
+
+		defs := make([]string, 0, len(code))
+		for def := range code {
+			defs = append(defs, def)
+		}
+		sort.Strings(defs)
+
+		table := ""
+		for _, def := range defs {
+			js := "function(_tmpls){return " + function(code[def]) + "}"
+			if _, ok := index[js]; !ok {
+				index[js] = len(trees)
+				trees = append(trees, js)
+			}
+			table += fmt.Sprintf("%s,%d,", strconv.Quote(def), index[js])
+		}
+		tables = append(tables, fmt.Sprintf("%s:_page(%s,[%s])",
+			strconv.Quote(name), strconv.Quote(page.root), strings.TrimSuffix(table, ",")))
+	}
+
+	return "(function(){var _trees=[" + strings.Join(trees, ",") + "];" +
+		page + "return {" + strings.Join(tables, ",") + "};})()", nil
+}
+
+// page builds the table of templates for a page of a bundle, from pairs of
+// names and indices into _trees, returning the root template. To render
+// others, it is given the same methods as the bundle.
+var page = minify(`
+	var _page = function(root, defs) {
+		var _tmpls = {}, names = [];
+		for (var i = 0; i < defs.length; i += 2) {
+			names.push(defs[i]);
+			_tmpls[defs[i]] = _trees[defs[i + 1]](_tmpls);
+		}
+		var f = _tmpls[root];
+		f.templates = _tmpls;
+		f.has = function(name) {
+			return Object.prototype.hasOwnProperty.call(_tmpls, name);
+		};
+		f.names = function() {
+			return names.slice();
+		};
+		f.render = function(name, data) {
+			if (!f.has(name)) {
+				throw new Error("no such template " + JSON.stringify(name));
+			}
+			return _tmpls[name](data);
+		};
+		return f;
+	};
+`)
+
+// ConvertTextLayouts compiles several template sets into one JavaScript
+// object, mapping each page name to the function that renders it. Typically,
+// each page is a Clone of a shared layout that overrides some of its blocks:
+//
+//	base := template.Must(template.New("base").Parse(
+//		`<h1>{{block "title" .}}Untitled{{end}}</h1>`))
+//	home := template.Must(template.Must(base.Clone()).Parse(
+//		`{{define "title"}}Home{{end}}`))
+//	js, err := tmpl2js.ConvertTextLayouts(map[string]*template.Template{
+//		"home": home,
+//		"other": base,
+//	}, &Page{}, nil)
+//
+// Each page executes the template named like the set itself, as Execute does.
+func ConvertTextLayouts(pages map[string]*text_template.Template, exampleContext interface{}, funcMap text_template.FuncMap, opts ...Option) (string, error) {
+	layouts := map[string]layout{}
+	for name, tmpl := range pages {
+		layouts[name] = textLayout(tmpl)
+	}
+	return bundle(layouts, exampleContext, funcMap, opts)
+}
+
+// ConvertHTMLLayouts is like ConvertTextLayouts, for html/template. As with
+// ConvertHTML, each page should have been executed (and hence escaped) first.
+func ConvertHTMLLayouts(pages map[string]*html_template.Template, exampleContext interface{}, funcMap html_template.FuncMap, opts ...Option) (string, error) {
+	layouts := map[string]layout{}
+	for name, tmpl := range pages {
+		layouts[name] = htmlLayout(tmpl)
 	}
-	return js + "_tmpls[\"" + name + "\"])", nil
+	return bundle(layouts, exampleContext, funcMap, opts)
 }
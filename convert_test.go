@@ -3,12 +3,18 @@ package tmpl2js_test
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/fatlotus/tmpl2js"
 	"github.com/robertkrimen/otto"
+	"math/big"
+	"strings"
 	"testing"
+	"time"
 
 	html "html/template"
 	text "text/template"
+	"text/template/parse"
 )
 
 type Context struct {
@@ -21,6 +27,24 @@ type Context struct {
 	F struct {
 		G string
 	}
+	K interface{}
+	L interface{}
+	M int    `json:",omitempty"`
+	N bool   `json:"n,string"`
+	O string `json:"-"`
+	P string `json:"first-name"`
+	S float64
+	T *Embedded
+	U []string
+	V map[string]int
+	W []string
+	X func(s string, n int) string `json:"-"`
+	Embedded
+}
+
+type Embedded struct {
+	Q string
+	R int `json:"r,omitempty"`
 }
 
 func (c Context) H() struct{ G string } {
@@ -31,7 +55,16 @@ func (c Context) I(a, b int) int {
 	return a + b
 }
 
+func (c Context) J(s string) (string, error) {
+	if s == "" {
+		return "", errors.New("empty string")
+	}
+	return "<" + s + ">", nil
+}
+
 var positive = []string{
+	`Escaped: {{"1+1 \"q\" <b>"}}`,
+	`Attributes: <a title="{{.A}} {{"1+1 \"q\""}}" href="/x?q={{.A}}&r={{.P}}">link</a>`,
 	`{{$var := .A}}{{$var}}`,
 	`{{range $i, $x := .C}}{{$i}}: {{$x.D}} = {{.D}}{{end}}`,
 	`{{range $i, $x := .E}}{{else}}nop{{end}}`,
@@ -43,23 +76,75 @@ var positive = []string{
 	`{{.H.G}} From global: {{$.H.G}}`,
 	`{{define "sub"}}G is: {{.F.G}}{{end}}{{template "sub" .}}`,
 	`{{define "sub"}}Sub{{end}}{{template "sub"}}`,
+	`{{define "sub"}}{{.}}{{if .}}yes{{end}}{{end}}{{template "sub"}}`,
+	`Assign: {{$n := 1}}{{$first := true}}{{range .E}}{{if $first}}first {{end}}{{$first = false}}{{$n = helper $n}}{{end}}{{$n}} {{$first}}`,
+	`Assign: {{$x := "x"}}{{if $x = .B}}yes{{end}}[{{$x}}] {{with $x = .A}}{{$x}}{{end}} {{$x}}`,
+	`Assign: {{$i := 0}}{{$e := ""}}{{range $i, $e = .E}}{{if eq $i 1}}{{break}}{{end}}{{end}}{{$i}}{{$e}}`,
+	`Assign: {{$x := 1}}{{if true}}{{$x := 2}}{{$x = 3}}{{end}}{{$x}}`,
+	`Scopes: {{if true}}{{$x := 1}}{{if true}}{{$x = 3}}{{$x := 2}}{{$x}}{{end}}{{$x}}{{end}}`,
+	`Scopes: {{if $x := .A}}{{if .B}}{{end}}{{$x}}{{end}} {{range $i, $e := .E}}{{range $.E}}{{end}}{{$i}}{{$e}}{{end}}`,
+	`Names: {{$out := "o"}}{{$ctx := "c"}}{{$it := "i"}}{{$class := "k"}}{{$new := 1}}{{range .E}}{{$out}}{{$ctx}}{{$it}}{{$class}}{{$new}}{{end}}`,
+	`Names: {{$helper := 1}}{{$eq := 2}}{{helper $helper}} {{eq $eq 2}}`,
+	`{{define "row"}}[{{.D}}]{{end}}{{range .C}}{{template "row" .}}{{end}}{{range $c := .C}}{{template "row" $c}}{{end}}`,
 	`Int: {{1}} float: {{1.2}} string: {{"hello"}} Bools: {{true}} {{false}}`,
 	`Variable: {{$x := .F}}{{$x.G}}`,
 	`Args: {{.I 3 4}}`,
 	`Comparison: {{lt 1 2}}`,
+	`String order: {{lt "\uE000" "\U0001F600"}} {{le "\U0001F600" "\uE000"}} {{lt "a" "ab"}}`,
 	`Helper: {{helper 42}} also: {{ 42 | helper }}`,
 	`Value of assignment: {{$x := ($y := 2)}}{{$x}} {{($y := .F).G}}`,
+	`Fallible: {{.J "x"}} {{"y" | .J}} {{checked 3}}`,
+	`Variadic: {{join ", " 1 "a" .A}} {{join "-"}} {{.A | join "/" .B}}`,
+	`Dynamic: {{.K.G}} {{range .L}}{{.}}{{end}} {{with .K}}{{.G}}{{end}}`,
+	`JSON: {{.M}} {{.N}} {{if .N}}yes{{end}} {{.P}} {{.Embedded.Q}} {{.Embedded.R}}`,
+	`Promoted: {{.Q}} {{.R}}`,
+	`Numbers: {{3}} {{3.0}} {{1.5}} {{1e6}} {{.S}} {{.R}} {{-0.00001}} {{.I 1 2}}`,
+	`Nil: {{.T}} {{.U}} {{.E}} {{if .T}}t{{end}}{{if .U}}u{{end}}{{if .W}}w{{end}}{{with .T}}{{.Q}}{{else}}none{{end}}`,
+	`Maps: {{.V.a}} {{.V.missing}} {{if .V}}v{{end}} {{range $k, $v := .V}}{{$k}}={{$v}} {{end}}`,
+	`Compare: {{eq .A "fieldA"}} {{eq .A "x" "fieldA"}} {{ne .B ""}} {{lt (.I 1 2) 5}} {{le 2 2}}`,
+	`Ordering: {{gt .S 1.5}} {{ge "b" "a"}} {{eq .M 0}} {{eq .N true}} {{eq .K.G "dynamic"}} {{if eq .R 0 1}}r{{end}}`,
+	`Call: {{call .X "ab" 2}} {{3 | call .X "-"}} {{$f := .X}}{{call $f "c" 1}}`,
+	`Break: {{range .E}}{{if eq . "E2"}}{{break}}{{end}}{{.}}{{end}} {{range $i, $e := .E}}{{if eq $i 1}}{{continue}}{{end}}{{with $e}}{{.}}{{end}}{{end}}`,
+	`Nested: {{range .E}}{{range $.E}}{{if eq . "E2"}}{{break}}{{end}}{{.}}{{end}}{{with .}}{{if eq . "E"}}{{continue}}{{end}}{{end}}|{{end}}`,
+	`Else: {{range .E}}{{range $.U}}{{else}}{{if eq . "E2"}}{{break}}{{else}}{{.}}{{end}}{{end}}{{.}}{{end}}`,
+	`Skip: {{range .E}}{{range $.U}}{{else}}{{if eq . "E2"}}{{continue}}{{end}}{{end}}{{.}}{{end}}`,
+	`Ints: {{range 3}}{{.}}{{end}} {{range $i := .I 1 1}}{{$i}}{{end}} {{range 0}}x{{else}}none{{end}}`,
+	`Else scope: {{$x := 1}}{{if false}}{{else}}{{$x := 2}}{{$x}}{{end}}{{$x}}`,
+	`Else scope: {{$x := 1}}{{with .T}}{{else}}{{$x := 2}}{{$x}}{{end}}{{$x}}`,
+	`Else scope: {{$x := 1}}{{range .U}}{{else}}{{$x := 2}}{{$x}}{{end}}{{$x}}`,
+	`Literals: {{0x1F}} {{0o17}} {{0b101}} {{1_000}} {{'a'}} {{0x1p-2}} {{1e3}} {{.I 0x10 'b'}}`,
+}
+
+func join(sep string, parts ...interface{}) string {
+	strs := make([]string, len(parts))
+	for i, part := range parts {
+		strs[i] = fmt.Sprint(part)
+	}
+	return strings.Join(strs, sep)
 }
 
 func TestConvertHTML(t *testing.T) {
 	ctx := &Context{
-		A: "fieldA",
-		B: "",
-		C: []struct{ D int }{{D: 4}},
-		E: []string{"E", "E2", "E3"},
-		F: struct{ G string }{G: "GggGG"},
+		A:        "fieldA",
+		B:        "",
+		C:        []struct{ D int }{{D: 4}},
+		E:        []string{"E", "E2", "E3"},
+		F:        struct{ G string }{G: "GggGG"},
+		K:        struct{ G string }{G: "dynamic"},
+		L:        []string{"x", "y"},
+		N:        true,
+		P:        "pp",
+		S:        1234567,
+		V:        map[string]int{"b": 2, "a": 1},
+		W:        []string{},
+		X:        strings.Repeat,
+		Embedded: Embedded{Q: "qq"},
+	}
+	helpers := html.FuncMap{
+		"helper":  func(x int) int { return 2 * x },
+		"checked": func(x int) (int, error) { return x, nil },
+		"join":    join,
 	}
-	helpers := html.FuncMap{"helper": func(x int) int { return 2 * x }}
 
 	for _, test := range positive {
 		t.Log(test)
@@ -90,6 +175,10 @@ func TestConvertHTML(t *testing.T) {
 		// Stub out the given method on the object.
 		js += "(x=" + string(data) + ",x.H=function() {return this.F},"
 		js += "x.I=function(a, b){return a + b},"
+		js += "x.J=function(s){return '<' + s + '>'},"
+		js += "x.X=function(s, n){return this === x ? 'bound' : new Array(n + 1).join(s)},"
+		js += "x.$checked=function(x){return x},"
+		js += "x.$join=function(sep){return [].slice.call(arguments, 1).join(sep)},"
 		js += "x.$helper=function(x){return 2 * x},x)"
 		t.Log(js)
 
@@ -107,13 +196,26 @@ func TestConvertHTML(t *testing.T) {
 
 func TestConvertText(t *testing.T) {
 	ctx := &Context{
-		A: "fieldA",
-		B: "",
-		C: []struct{ D int }{{D: 4}},
-		E: []string{"E", "E2", "E3"},
-		F: struct{ G string }{G: "GggGG"},
+		A:        "fieldA",
+		B:        "",
+		C:        []struct{ D int }{{D: 4}},
+		E:        []string{"E", "E2", "E3"},
+		F:        struct{ G string }{G: "GggGG"},
+		K:        struct{ G string }{G: "dynamic"},
+		L:        []string{"x", "y"},
+		N:        true,
+		P:        "pp",
+		S:        1234567,
+		V:        map[string]int{"b": 2, "a": 1},
+		W:        []string{},
+		X:        strings.Repeat,
+		Embedded: Embedded{Q: "qq"},
+	}
+	helpers := text.FuncMap{
+		"helper":  func(x int) int { return 2 * x },
+		"checked": func(x int) (int, error) { return x, nil },
+		"join":    join,
 	}
-	helpers := text.FuncMap{"helper": func(x int) int { return 2 * x }}
 
 	for _, test := range positive {
 		t.Log(test)
@@ -144,6 +246,10 @@ func TestConvertText(t *testing.T) {
 		// Stub out the given method on the object.
 		js += "(x=" + string(data) + ",x.H=function() {return this.F},"
 		js += "x.I=function(a, b){return a + b},"
+		js += "x.J=function(s){return '<' + s + '>'},"
+		js += "x.X=function(s, n){return this === x ? 'bound' : new Array(n + 1).join(s)},"
+		js += "x.$checked=function(x){return x},"
+		js += "x.$join=function(sep){return [].slice.call(arguments, 1).join(sep)},"
 		js += "x.$helper=function(x){return 2 * x},x)"
 		t.Log(js)
 
@@ -171,11 +277,40 @@ var negative = []string{
 	`{{range .I}}{{end}}`,
 	`{{.C.D}}`,
 	`{{range true}}{{end}}`,
-	`{{range 0}}{{end}}`,
+	`{{range 1.5}}{{end}}`,
+	`{{range $i, $e := 5}}{{end}}`,
 	`{{range ""}}{{end}}`,
 	`{{range .}}{{end}}`,
 	`{{range $}}{{end}}`,
 	`{{fake}}`,
+	`{{.I 1}}`,
+	`{{.I "a" "b"}}`,
+	`{{.A 1}}`,
+	`{{$x := .F}}{{$x 1}}`,
+	`{{"a" | .F.G}}`,
+	`{{.O}}`,
+	`{{.I 1.5 2}}`,
+	`{{1i}}`,
+	`{{18446744073709551615}}`,
+	`{{eq .A 1}}`,
+	`{{eq .S 1}}`,
+	`{{lt true false}}`,
+	`{{eq .A}}`,
+	`{{lt 1 2 3}}`,
+	`{{eq .C .C}}`,
+	`{{.X "a" 2}}`,
+	`{{call .X "a"}}`,
+	`{{call .X "a" "b"}}`,
+	`{{call .A}}`,
+	`{{call}}`,
+	`{{define "x"}}{{.A}}{{end}}{{template "x" .F}}`,
+	`{{define "x"}}{{end}}{{template "x" .A}}{{template "x" .S}}`,
+	`{{template "missing"}}`,
+	`{{define "x"}}{{.A}}{{end}}{{template "x"}}`,
+	`{{define "x"}}{{end}}{{template "x"}}{{template "x" .}}`,
+	`{{$x := 1}}{{$x = "a"}}`,
+	`{{$x := .F}}{{range $x = .E}}{{end}}`,
+	`{{define "x"}}{{end}}{{if .N}}{{template "y" .}}{{end}}`,
 }
 
 func TestFailureText(t *testing.T) {
@@ -208,3 +343,743 @@ func TestFailureHTML(t *testing.T) {
 		t.Log(err.Error())
 	}
 }
+
+func TestCallErrors(t *testing.T) {
+	tmpl, err := text.New("").Parse(`{{.J ""}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpl.Execute(&bytes.Buffer{}, &Context{}); err == nil {
+		t.Fatal("expected text/template to fail")
+	}
+
+	js, err := tmpl2js.ConvertText(tmpl, &Context{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Methods may either throw or return an Error to abort the render.
+	stubs := []string{
+		"function(s){throw new Error('empty string')}",
+		"function(s){return new Error('empty string')}",
+	}
+	for _, stub := range stubs {
+		_, _, err := otto.Run(js + "({J:" + stub + "})")
+		if err == nil {
+			t.Fatalf("expected an error from %s", stub)
+		}
+		if !strings.Contains(err.Error(), "error calling J: empty string") {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+}
+
+func TestCallOfNil(t *testing.T) {
+	tmpl, err := text.New("").Parse(`{{call .X "a" 1}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpl.Execute(&bytes.Buffer{}, &Context{}); err == nil {
+		t.Fatal("expected text/template to fail")
+	}
+
+	js, err := tmpl2js.ConvertText(tmpl, &Context{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = otto.Run(js + "({})")
+	if err == nil || !strings.Contains(err.Error(), "error calling call: call of nil") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestMissingValues(t *testing.T) {
+	// Go sorts keys by their bytes, which browsers (though not otto) order
+	// differently from their UTF-16 code units.
+	ctx := &Context{V: map[string]int{"a": 1, "\uE000": 2, "\U0001F600": 3}}
+	data, err := json.Marshal(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct{ template, option string }{
+		{`{{.V.a}} {{.V.b}}`, "missingkey=default"},
+		{`{{.V.a}} {{.V.b}}`, "missingkey=zero"},
+		{`{{.V.a}} {{.V.b}}`, "missingkey=error"},
+		{`{{.V.a}} {{.T.Q}}`, "missingkey=default"},
+		{`{{range $k, $v := .V}}{{$k}}={{$v}} {{end}}`, "missingkey=default"},
+	} {
+		t.Log(test.template, test.option)
+
+		tmpl, err := text.New("").Option(test.option).Parse(test.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := bytes.Buffer{}
+		goErr := tmpl.Execute(&buf, ctx)
+
+		js, err := tmpl2js.ConvertText(tmpl, &Context{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, val, err := otto.Run(js + "(" + string(data) + ")")
+
+		switch {
+		case goErr != nil && err == nil:
+			t.Fatalf("expected an error like %q", goErr)
+		case goErr == nil && err != nil:
+			t.Fatal(err)
+		case err != nil:
+			if strings.Contains(err.Error(), "TypeError") {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			t.Log(err)
+		case val.String() != buf.String():
+			t.Fatalf("%s != %s", val.String(), buf.String())
+		}
+	}
+
+	// The option may also be given explicitly, but must agree with the
+	// template's own, which html/template templates have too.
+	tmpl := html.Must(html.New("").Option("missingkey=zero").Parse(`{{.V.b}}`))
+	if _, err := tmpl2js.ConvertHTML(tmpl, &Context{}, nil, tmpl2js.WithMissingKey("zero")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmpl2js.ConvertHTML(tmpl, &Context{}, nil, tmpl2js.WithMissingKey("default")); err == nil {
+		t.Fatal("expected an error from the conflicting missingkey options")
+	}
+}
+
+func TestEscapers(t *testing.T) {
+	corpus := []string{
+		"",
+		"plain text",
+		"<script>alert('x & y')</script>",
+		"a=b \"c\" \\d",
+		"\x00\x01\t\n\r\x1f\x7f",
+		"héllo wörld, 日本語, emoji 😀 and 𝔘𝔫𝔦𝔠𝔬𝔡𝔢",
+		"\u00a0\u00ad\u200b\u2028\u2029\ufeff\u0378\ue000",
+		"\U000e0001\U0010fffd\U0001f3fb",
+		"a b+c/d?e=f&g~h*i(j)k!l'm;n:o@p$q,r#s[t]u%v",
+	}
+	type Input struct{ S string }
+	tmpl, err := text.New("").Parse(`{{html .S}}|{{js .S}}|{{urlquery .S}}|` +
+		`{{.S | html}}|{{js .S 1 2 "x" 3.5}}|{{urlquery 1 2.5 true .S}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	js, err := tmpl2js.ConvertText(tmpl, Input{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range corpus {
+		buf := bytes.Buffer{}
+		if err := tmpl.Execute(&buf, Input{test}); err != nil {
+			t.Fatal(err)
+		}
+		data, err := json.Marshal(Input{test})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, val, err := otto.Run(js + "(" + string(data) + ")")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val.String() != buf.String() {
+			t.Fatalf("%q != %q", val.String(), buf.String())
+		}
+	}
+}
+
+func TestRuntimeChecks(t *testing.T) {
+	tests := []string{
+		`{{.K.Missing}}`,
+		`{{.K.G 1}}`,
+		`{{range .K.G}}{{end}}`,
+		`{{.L.G}}`,
+		`{{eq .K "dynamic"}}`,
+		`{{lt .K.G 1}}`,
+	}
+	for _, test := range tests {
+		tmpl, err := text.New("").Parse(test)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		js, err := tmpl2js.ConvertText(tmpl, &Context{}, nil, tmpl2js.WithRuntimeChecks())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = otto.Run(js + `({K: {G: "dynamic"}, L: null})`)
+		if err == nil {
+			t.Fatalf("expected a runtime error from %s", test)
+		}
+		if strings.Contains(err.Error(), "TypeError") {
+			t.Fatalf("expected a descriptive error from %s, got %s", test, err)
+		}
+		t.Log(err)
+	}
+}
+
+type Any struct {
+	K interface{}
+}
+
+func TestDynamicValues(t *testing.T) {
+	tests := []struct {
+		template string
+		value    interface{}
+	}{
+		{`{{.K}} {{range .K}}x{{else}}none{{end}}`, nil},
+		{`{{range .K}}{{.}}{{end}} {{range $k, $v := .K}}{{$k}}={{$v}};{{end}}`, map[string]int{"b": 2, "a": 1}},
+		{`{{range .K}}{{.}}{{end}} {{range $i, $v := .K}}{{$i}}={{$v}};{{end}}`, []string{"x", "y"}},
+		{`{{range .K}}{{.}}{{end}}`, 3},
+	}
+	for _, test := range tests {
+		tmpl := text.Must(text.New("").Parse(test.template))
+		checkRender(t, tmpl, &Any{test.value}, "", "")
+		checkRender(t, tmpl, &Any{test.value}, "", "", tmpl2js.WithRuntimeChecks())
+	}
+
+	// Even without runtime checks, a nil interface has no fields.
+	tmpl := text.Must(text.New("").Parse(`{{.K.G}}`))
+	js, err := tmpl2js.ConvertText(tmpl, &Any{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = otto.Run(js + `({K: null})`)
+	if err == nil || !strings.Contains(err.Error(), "nil pointer evaluating interface {}.G") {
+		t.Fatalf("expected a nil pointer error, got %v", err)
+	}
+}
+
+// render converts tmpl, with data as its example context, and runs it in otto
+// after prelude. The data is encoded with EncodeJSON, and assigned to x before
+// client (if any) runs, so that it can add what JSON leaves out (e.g. methods).
+func render(t *testing.T, tmpl *text.Template, data interface{}, prelude, client string, opts ...tmpl2js.Option) string {
+	t.Helper()
+	js, err := tmpl2js.ConvertText(tmpl, data, nil, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := tmpl2js.EncodeJSON(data, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client != "" {
+		client += ","
+	}
+	_, val, err := otto.Run(prelude + js + "(x=" + string(encoded) + "," + client + "x)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return val.String()
+}
+
+// checkRender checks that render prints what Execute does.
+func checkRender(t *testing.T, tmpl *text.Template, data interface{}, prelude, client string, opts ...tmpl2js.Option) {
+	t.Helper()
+	buf := bytes.Buffer{}
+	if err := tmpl.Execute(&buf, data); err != nil {
+		t.Fatal(err)
+	}
+	if val := render(t, tmpl, data, prelude, client, opts...); val != buf.String() {
+		t.Fatalf("%s != %s", val, buf.String())
+	}
+}
+
+type Feed struct {
+	Items func(yield func(string) bool)         `json:"-"`
+	Pairs func(yield func(string, int) bool)    `json:"-"`
+	Empty func(yield func(int, *Embedded) bool) `json:"-"`
+}
+
+func TestIterators(t *testing.T) {
+	feed := &Feed{
+		Items: func(yield func(string) bool) {
+			for _, item := range []string{"a", "b", "c"} {
+				if !yield(item) {
+					return
+				}
+			}
+		},
+		Pairs: func(yield func(string, int) bool) {
+			for i, key := range []string{"x", "y", "z"} {
+				if !yield(key, i+1) {
+					return
+				}
+			}
+		},
+		Empty: func(yield func(int, *Embedded) bool) {},
+	}
+	tmpl, err := text.New("").Parse(`{{range .Items}}{{.}},{{end}}|` +
+		`{{range $k, $v := .Pairs}}{{$k}}={{$v}};{{if eq $v 2}}{{break}}{{end}}{{end}}|` +
+		`{{range .Pairs}}{{.}}{{end}}|{{range .Empty}}{{.}}{{else}}empty{{end}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The client may provide arrays, functions taking a yield callback, or
+	// iterators (such as generators).
+	clients := []string{
+		`x.Items = ["a", "b", "c"], x.Pairs = [["x", 1], ["y", 2], ["z", 3]], x.Empty = []`,
+		`x.Items = function(y) { y("a") && y("b") && y("c"); },
+		 x.Pairs = function(y) { y("x", 1) && y("y", 2) && y("z", 3); },
+		 x.Empty = function(y) {}`,
+		`x.Items = function() { var i = 0, v = ["a", "b", "c"];
+		   return {next: function() { return {done: i >= v.length, value: v[i++]}; }}; },
+		 x.Pairs = function() { var i = 0;
+		   return {next: function() { return {done: i >= 3, value: [["x", "y", "z"][i], ++i]}; }}; },
+		 x.Empty = {next: function() { return {done: true}; }}`,
+	}
+	for _, client := range clients {
+		checkRender(t, tmpl, feed, "", client)
+	}
+}
+
+type Node struct {
+	Name     string
+	Children []Node
+	Replies  []*Node
+}
+
+func TestRecursiveTypes(t *testing.T) {
+	tree := &Node{
+		Name: "root",
+		Children: []Node{
+			{Name: "a", Children: []Node{{Name: "b"}}},
+			{Name: "c", Replies: []*Node{{Name: "d"}}},
+		},
+	}
+
+	tmpl, err := text.New("").Parse(`{{define "node"}}{{.Name}}(` +
+		`{{range .Children}}{{template "node" .}}{{end}}` +
+		`{{range .Replies}}{{template "node" .}}{{end}}){{end}}` +
+		`{{template "node" .}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRender(t, tmpl, tree, "", "")
+}
+
+func TestLayouts(t *testing.T) {
+	base := text.Must(text.New("base").Parse(`<h1>{{block "title" .}}Untitled{{end}}</h1>` +
+		`{{block "content" .}}{{.Name}}{{end}}`))
+	home := text.Must(text.Must(base.Clone()).Parse(`{{define "title"}}Home{{end}}`))
+	about := text.Must(text.Must(base.Clone()).Parse(`{{define "title"}}About{{end}}` +
+		`{{define "content"}}All about {{.Name}}{{end}}`))
+	pages := map[string]*text.Template{"base": base, "home": home, "about": about}
+
+	js, err := tmpl2js.ConvertTextLayouts(pages, &Node{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(js, "Untitled") != 1 || strings.Count(js, "About") != 1 {
+		t.Fatalf("shared trees should be converted once: %s", js)
+	}
+
+	for name, tmpl := range pages {
+		buf := bytes.Buffer{}
+		if err := tmpl.Execute(&buf, &Node{Name: "x"}); err != nil {
+			t.Fatal(err)
+		}
+
+		vm := otto.New()
+		val, err := vm.Run("(" + js + ")[" + fmt.Sprintf("%q", name) + "]({Name: 'x'})")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val.String() != buf.String() {
+			t.Fatalf("%s: %s != %s", name, val.String(), buf.String())
+		}
+
+		// The tables of templates are private to each page.
+		if val, _ := vm.Run("typeof _tmpls"); val.String() != "undefined" {
+			t.Fatalf("_tmpls leaked into the global scope")
+		}
+	}
+}
+
+func TestPartialTypes(t *testing.T) {
+	// The type of a partial comes from its caller, whichever sorts first.
+	for _, name := range []string{"a_row", "row", ""} {
+		tmpl := text.Must(text.New("page").Parse(fmt.Sprintf(`{{define %q}}[{{.D}}]{{end}}`+
+			`{{range .C}}{{template %q .}}{{end}}`, name, name)))
+		js, err := tmpl2js.ConvertText(tmpl, &Context{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, val, err := otto.Run(js + `({C: [{D: 1}, {D: 2}]})`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val.String() != "[1][2]" {
+			t.Fatalf("%q: unexpected output: %s", name, val.String())
+		}
+	}
+}
+
+func TestRootTemplate(t *testing.T) {
+	tmpl := text.Must(text.New("page").Parse(`{{define "a"}}A{{.Name}}{{end}}` +
+		`{{define "b"}}B{{end}}{{define "c"}}C{{end}}page:{{template "a" .}}`))
+
+	js, err := tmpl2js.ConvertText(tmpl, &Node{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		again, err := tmpl2js.ConvertText(tmpl, &Node{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again != js {
+			t.Fatalf("output differs between conversions")
+		}
+	}
+
+	_, val, err := otto.Run("f=" + js + `,f({Name: "x"}) + "|" + f.templates.a({Name: "y"}) + f.templates.b()`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val.String() != "page:Ax|AyB" {
+		t.Fatalf("unexpected output: %s", val.String())
+	}
+
+	// Any template may be rendered by name.
+	_, val, err = otto.Run("f=" + js + `,f.render("a", {Name: "z"}) + f.has("c") + f.has("d") + f.names()`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val.String() != "Aztruefalsea,b,c,page" {
+		t.Fatalf("unexpected output: %s", val.String())
+	}
+	_, _, err = otto.Run("(" + js + `).render("d", {})`)
+	if err == nil || !strings.Contains(err.Error(), `no such template "d"`) {
+		t.Fatalf("expecting error from an unknown template, got %v", err)
+	}
+
+	// Templates that aren't included may be given their own type.
+	tmpl = text.Must(text.New("page").Parse(`{{define "card"}}{{.G}}{{end}}{{.Name}}`))
+	if _, err := tmpl2js.ConvertText(tmpl, &Node{}, nil); err == nil {
+		t.Fatalf("expecting error from a template of the wrong type")
+	}
+	js, err = tmpl2js.ConvertText(tmpl, &Node{}, nil,
+		tmpl2js.WithTemplateContext("card", struct{ G string }{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, val, err = otto.Run("(" + js + `).templates.card({G: "g"})`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val.String() != "g" {
+		t.Fatalf("unexpected output: %s", val.String())
+	}
+
+	// The data passed to a template must agree with the type it was given.
+	tmpl = text.Must(text.New("page").Parse(`{{define "card"}}{{.}}{{end}}{{template "card" .Name}}`))
+	if _, err := tmpl2js.ConvertText(tmpl, &Node{}, nil,
+		tmpl2js.WithTemplateContext("card", 0)); err == nil {
+		t.Fatalf("expecting error from passing a string to an int template")
+	}
+	var anything interface{}
+	if _, err := tmpl2js.ConvertText(tmpl, &Node{}, nil,
+		tmpl2js.WithTemplateContext("card", &anything)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tmpl2js.ConvertText(text.New("empty"), &Node{}, nil); err == nil {
+		t.Fatalf("expecting error from a template without a tree")
+	}
+}
+
+func TestComments(t *testing.T) {
+	tree := parse.New("page")
+	tree.Mode = parse.ParseComments
+	_, err := tree.Parse(`{{/* Greet the user */}}Hello, {{.Name}}!`+
+		`{{range .Children}}{{/* one */}}{{- /* trimmed */ -}} {{.Name}}{{end}}`,
+		"{{", "}}", map[string]*parse.Tree{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := text.New("page").AddParseTree("page", tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := &Node{Name: "x", Children: []Node{{Name: "a"}, {Name: "b"}}}
+	buf := bytes.Buffer{}
+	if err := tmpl.Execute(&buf, node); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, debug := range []bool{false, true} {
+		opts := []tmpl2js.Option{}
+		if debug {
+			opts = append(opts, tmpl2js.WithDebug())
+		}
+		js, err := tmpl2js.ConvertTree(tree, &Node{}, nil, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(js, "/* Greet the user */\nout+=") != debug {
+			t.Fatalf("comments should only be kept in debug mode: %s", js)
+		}
+		_, val, err := otto.Run(js + `({Name: "x", Children: [{Name: "a"}, {Name: "b"}]})`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val.String() != buf.String() {
+			t.Fatalf("%s != %s", val.String(), buf.String())
+		}
+	}
+}
+
+type Totals struct {
+	Count int
+	Label string `json:",string"`
+	Embedded
+}
+
+type Sparse struct {
+	Z Totals `json:",omitzero"`
+	N int    `json:",omitzero"`
+}
+
+func TestOmitZero(t *testing.T) {
+	tmpl := text.Must(text.New("").Parse(`{{.Z.Count}} {{.Z.Label}} {{.Z.Q}} {{.Z.R}} {{.N}}`))
+	checkRender(t, tmpl, &Sparse{}, "", "")
+	checkRender(t, tmpl, &Sparse{Z: Totals{Count: 2, Label: "x", Embedded: Embedded{R: 3}}, N: 1}, "", "")
+}
+
+type Money int
+
+func (m Money) MarshalJSON() ([]byte, error) {
+	return json.Marshal(fmt.Sprintf("$%d.%02d", m/100, m%100))
+}
+
+type Event struct {
+	When   time.Time
+	Data   []byte
+	Raw    json.RawMessage
+	Amount *big.Int
+	Cost   Money
+}
+
+func TestCustomEncodings(t *testing.T) {
+	event := &Event{
+		When:   time.Date(2009, 11, 10, 23, 0, 0, 0, time.UTC),
+		Data:   []byte("hi"),
+		Raw:    json.RawMessage(`{"x": 1}`),
+		Amount: big.NewInt(12345),
+		Cost:   Money(1999),
+	}
+
+	tmpl, err := text.New("").Parse(
+		`{{.When}} {{.Data}} {{.Raw.x}} {{.Amount}} {{.Cost}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// As documented, these are the JSON forms of the values, rather than what
+	// Execute prints ("2009-11-10 23:00:00 +0000 UTC [104 105] ...").
+	val := render(t, tmpl, event, "", "", tmpl2js.WithType(Money(0), ""))
+	expected := "2009-11-10T23:00:00Z aGk= 1 12345 $19.99"
+	if val != expected {
+		t.Fatalf("%s != %s", val, expected)
+	}
+
+	// Strings have no methods on the client side.
+	tmpl, err = text.New("").Parse(`{{.When.Year}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmpl2js.ConvertText(tmpl, &Event{}, nil); err == nil {
+		t.Fatal("expected an error from .When.Year")
+	}
+
+	// Without WithType, Money is dynamic, so it may have any field.
+	tmpl, err = text.New("").Parse(`{{.Cost.Cents}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmpl2js.ConvertText(tmpl, &Event{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tmpl2js.ConvertText(tmpl, &Event{}, nil, tmpl2js.WithType(Money(0), "")); err == nil {
+		t.Fatal("expected an error from .Cost.Cents")
+	}
+}
+
+type Layout struct {
+	Title  string
+	Author string
+}
+
+func (l Layout) Heading() string {
+	return "# " + l.Title
+}
+
+type Meta struct {
+	Author string
+	Tags   []string
+}
+
+type Page struct {
+	*Layout
+	Meta
+	Body string
+}
+
+func TestEmbedding(t *testing.T) {
+	page := &Page{
+		Layout: &Layout{Title: "Hello"},
+		Meta:   Meta{Tags: []string{"a", "b"}},
+		Body:   "World",
+	}
+	tmpl, err := text.New("").Parse(
+		`{{.Heading}}: {{.Title}} {{.Layout.Title}} {{.Body}} {{range .Tags}}{{.}}{{end}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRender(t, tmpl, page, "", "x.Heading = function() { return '# ' + this.Title; }")
+
+	// Author is ambiguous, so Go refuses to resolve it.
+	tmpl, err = text.New("").Parse(`{{.Author}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tmpl.Execute(&bytes.Buffer{}, page); err == nil {
+		t.Fatal("expected text/template to fail")
+	}
+	if _, err := tmpl2js.ConvertText(tmpl, &Page{}, nil); err == nil {
+		t.Fatal("expected an error from the ambiguous .Author")
+	}
+}
+
+type Counter struct {
+	N     int
+	Items []Counter
+}
+
+func (c *Counter) Double() int {
+	return 2 * c.N
+}
+
+func (c Counter) Copy() Counter {
+	return c
+}
+
+func TestPointerMethods(t *testing.T) {
+	counter := &Counter{N: 1, Items: []Counter{{N: 2}, {N: 3}}}
+	tmpl, err := text.New("").Parse(
+		`{{.Double}} {{range .Items}}{{.Double}}{{end}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRender(t, tmpl, counter, "", "x.Double = function() { return 2 * this.N; }, "+
+		"x.Items.forEach(function(i) { i.Double = x.Double; })")
+
+	// A partial may be included with both addressable and unaddressable
+	// values of the same type.
+	tmpl = text.Must(text.New("").Parse(`{{define "c"}}{{.N}}{{end}}{{template "c" .}}{{template "c" .Copy}}`))
+	checkRender(t, tmpl, counter, "", "x.Copy = function() { return this; }")
+	tmpl = text.Must(text.New("").Parse(`{{define "c"}}{{.N}}{{range .Items}}{{template "c" .}}{{end}}{{end}}` +
+		`{{template "c" .}}`))
+	checkRender(t, tmpl, *counter, "", "")
+
+	// Neither a struct passed by value nor a method result is addressable.
+	tests := []struct {
+		template string
+		ctx      interface{}
+	}{
+		{`{{.Double}}`, Counter{}},
+		{`{{.Copy.Double}}`, &Counter{}},
+	}
+	for _, test := range tests {
+		tmpl, err := text.New("").Parse(test.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tmpl.Execute(&bytes.Buffer{}, test.ctx); err == nil {
+			t.Fatalf("expected text/template to fail on %s", test.template)
+		}
+		if _, err := tmpl2js.ConvertText(tmpl, test.ctx, nil); err == nil {
+			t.Fatalf("expected an error from %s", test.template)
+		}
+	}
+}
+
+type Account struct {
+	ID       int64
+	Balance  uint64 `json:",omitempty"`
+	Accounts []uint64
+	Limits   map[string]int64
+}
+
+func (a Account) Total() uint64 {
+	return a.Balance
+}
+
+// bigIntPolyfill stands in for BigInt, which otto lacks, by interning an
+// object for each integer.
+const bigIntPolyfill = `
+	var BigInt = (function() {
+		var cache = {};
+		var BigInt = function(x) {
+			var s = String(x);
+			if (!/^-?\d+$/.test(s)) {
+				throw new RangeError("can't convert " + s + " to a BigInt");
+			}
+			return cache[s] || (cache[s] = Object.create(BigInt.prototype, {s: {value: s}}));
+		};
+		BigInt.prototype.toString = BigInt.prototype.valueOf = function() {
+			return this.s;
+		};
+		return BigInt;
+	})();
+`
+
+func TestBigIntegers(t *testing.T) {
+	account := &Account{
+		ID:       1<<53 + 1,
+		Balance:  1<<64 - 1,
+		Accounts: []uint64{1<<63 + 1},
+		Limits:   map[string]int64{"daily": -1<<63 + 1},
+	}
+	tmpl, err := text.New("").Parse(`{{.ID}} {{.Balance}} {{range .Accounts}}{{.}}{{end}} {{9007199254740993}} ` +
+		`{{eq .ID 9007199254740993}} {{js .ID}} {{urlquery .ID .Balance}} {{range .Limits}}{{.}}{{end}} {{.Total}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without big integers, precision is lost (with a warning).
+	warnings := 0
+	warn := func(msg string) {
+		t.Log(msg)
+		warnings++
+	}
+	_, err = tmpl2js.ConvertText(tmpl, &Account{}, nil, tmpl2js.WithWarnings(warn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if warnings != 11 {
+		t.Fatalf("expected 11 warnings, got %d", warnings)
+	}
+
+	// With them, values are sent as strings. Check both without BigInt (as
+	// in otto), and with a minimal polyfill, whose values (like BigInts) are
+	// equal if they hold the same integer.
+	opts := []tmpl2js.Option{tmpl2js.WithBigIntegers(), tmpl2js.WithWarnings(warn)}
+	for _, prelude := range []string{"", bigIntPolyfill} {
+		checkRender(t, tmpl, account, prelude, "x.Total = function() { return this.Balance; }", opts...)
+	}
+
+	// Only BigInts can tell 2^53+1 from 2^53; without them, precision is lost.
+	tmpl = text.Must(text.New("").Parse(`{{eq .ID 9007199254740992}} {{ne .ID 9007199254740992}}`))
+	if val := render(t, tmpl, account, bigIntPolyfill, "", opts...); val != "false true" {
+		t.Fatalf("unexpected output: %s", val)
+	}
+	if warnings != 11 {
+		t.Fatalf("expected no more warnings, got %d", warnings-11)
+	}
+}
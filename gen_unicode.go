@@ -0,0 +1,51 @@
+//go:build ignore
+
+// This program generates unicode.go, which describes unicode.IsPrint for the
+// JavaScript port of text/template's js function.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+func main() {
+	var parts []string
+	prev := rune(utf8.RuneSelf)
+	for r := prev; r <= unicode.MaxRune; {
+		if unicode.IsPrint(r) {
+			r++
+			continue
+		}
+		lo := r
+		for r <= unicode.MaxRune && !unicode.IsPrint(r) {
+			r++
+		}
+		parts = append(parts,
+			strconv.FormatInt(int64(lo-prev), 36), strconv.FormatInt(int64(r-lo), 36))
+		prev = r
+	}
+
+	buf := bytes.Buffer{}
+	fmt.Fprintf(&buf, "// Code generated by gen_unicode.go; DO NOT EDIT.\n\n")
+	fmt.Fprintf(&buf, "package tmpl2js\n\n")
+	fmt.Fprintf(&buf, "// nonPrintable lists the non-ASCII runes that aren't printable according to\n")
+	fmt.Fprintf(&buf, "// unicode.IsPrint (Unicode %s), as comma-separated pairs of base-36\n", unicode.Version)
+	fmt.Fprintf(&buf, "// numbers: the distance from the end of the previous range, and the length\n")
+	fmt.Fprintf(&buf, "// of the range.\n")
+	fmt.Fprintf(&buf, "const nonPrintable = %q\n", strings.Join(parts, ","))
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile("unicode.go", src, 0644); err != nil {
+		panic(err)
+	}
+}
@@ -3,3 +3,5 @@
 // applications (with dynamic, partial page updates), without writing much
 // JavaScript.
 package tmpl2js
+
+//go:generate go run gen_unicode.go